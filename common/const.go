@@ -8,6 +8,12 @@ const (
 	DeployTypeTracker  = "tracker"
 )
 
+//http_schema
+const (
+	HttpSchema  = "http"
+	HttpsSchema = "https"
+)
+
 //返回码
 const (
 	//common
@@ -25,6 +31,17 @@ const (
 	ProxyBadGateWay
 	FileCheckSumFail
 	ParamBindFail
+	ChunkUploadNotFound
+	ChunkPartInvalid
+	ChunkIncomplete
+	UploadOffsetMismatch
+	UploadLocked
+	DownloadTokenInvalid
+	FileNotFound
+	WriteConcernFail
+	AuthFail
+	PermissionDenied
+	PathInvalid
 )
 
 //http请求头
@@ -35,6 +52,20 @@ const (
 	HeaderFileHash         = "Egg-Dfs-FIle-Hash"
 	HeaderFilePath         = "Egg-Dfs-FIle-File"
 	HeaderDownloadFilename = "Egg-Dfs-Download-Filename"
+	HeaderUploadId         = "Egg-Dfs-Upload-Id"
+	HeaderUploadOffset     = "Upload-Offset"
+	HeaderUploadLength     = "Upload-Length"
+	HeaderWriteConcern     = "Egg-Dfs-Write-Concern"
+	HeaderReplicas         = "Egg-Dfs-Replicas"
+	HeaderGroup            = "Egg-Dfs-Group"
+	HeaderAuthKey          = "Egg-Dfs-Key"
+	HeaderAuthTimestamp    = "Egg-Dfs-Timestamp"
+	HeaderAuthNonce        = "Egg-Dfs-Nonce"
+	HeaderAuthSignature    = "Egg-Dfs-Signature"
+	HeaderAuthContentHash  = "Egg-Dfs-Content-Sha256"
+	HeaderNodeTimestamp    = "Egg-Dfs-Node-Timestamp"
+	HeaderNodeNonce        = "Egg-Dfs-Node-Nonce"
+	HeaderNodeSignature    = "Egg-Dfs-Node-Signature"
 )
 
 //group状态标识
@@ -48,6 +79,46 @@ const (
 	StorageOffline = iota
 	StorageActive
 	StorageNotEnoughSpace
+	StorageSyncing     //全量同步中 不参与读写
+	StoragePending     //tracker重启后从持久化记录恢复 等待心跳确认
+	StorageMaintenance //运维设置 维护中 不参与读写
+	StorageDraining    //运维设置 排空中 不接受新的上传 仍处理读取以及进行中的上传
+	StorageReadOnly    //运维设置 只读 只处理读取
+)
+
+//下载方式
+const (
+	DownloadModeProxy    = "proxy"
+	DownloadModeRedirect = "redirect"
+)
+
+//group访问模式 private时storage只提供携带有效下载签名的文件
+const (
+	AccessPublic  = "public"
+	AccessPrivate = "private"
+)
+
+//写入级别 上传成功前需要确认的副本数
+const (
+	WriteConcernOne    = "ONE"
+	WriteConcernQuorum = "QUORUM"
+	WriteConcernAll    = "ALL"
+)
+
+//上传group选择策略
+const (
+	GroupSelectMaxFree    = "max_free"
+	GroupSelectRoundRobin = "round_robin"
+	GroupSelectWeighted   = "weighted"
+	GroupSelectHeader     = "header"
+)
+
+//group内storage选择策略
+const (
+	StorageSelectHash          = "consistent_hash"
+	StorageSelectRoundRobin    = "round_robin"
+	StorageSelectLeastInFlight = "least_inflight"
+	StorageSelectWeighted      = "weighted"
 )
 
 //sync option
@@ -56,8 +127,98 @@ const (
 	SyncDelete = "DELETE"
 )
 
+//bootstrap state
+const (
+	BootstrapRunning = "RUNNING"
+	BootstrapDone    = "DONE"
+	BootstrapFailed  = "FAILED"
+)
+
+//decommission state
+const (
+	DecommissionRunning   = "RUNNING"
+	DecommissionVerifying = "VERIFYING"
+	DecommissionDone      = "DONE"
+	DecommissionFailed    = "FAILED"
+	DecommissionCanceled  = "CANCELED"
+)
+
+//sync task state
+const (
+	SyncTaskPending = "PENDING"
+	SyncTaskDead    = "DEAD"
+)
+
 const MinStorageSpace = 100000
 
+//MaxChunkParts 单个分片上传允许的最大分片数
+const MaxChunkParts = 10000
+
+//api key角色 admin可访问所有接口 write可上传与删除 read只能查询与下载
+const (
+	AuthRoleRead  = "read"
+	AuthRoleWrite = "write"
+	AuthRoleAdmin = "admin"
+)
+
+//DefaultAuthSkew api key签名允许的时间误差 单位秒
+const DefaultAuthSkew = 300
+
+//DefaultAuthBodyMax api key认证时暂存请求体的最大长度 单位MB
+const DefaultAuthBodyMax = 1024
+
+//DefaultProxyAttempts 代理请求默认的最大尝试次数
+const DefaultProxyAttempts = 3
+
+//DefaultRedirectTokenTTL 重定向下载签名默认有效期 单位秒
+const DefaultRedirectTokenTTL = 60
+
+//签名下载地址默认以及最大有效期 单位秒
+const (
+	DefaultSignedUrlTTL    = 3600
+	DefaultSignedUrlMaxTTL = 7 * 24 * 3600
+)
+
+//同步任务默认的最大尝试次数以及退避间隔 单位秒
+const (
+	DefaultSyncMaxAttempts = 10
+	DefaultSyncRetryBase   = 10
+	DefaultSyncRetryMax    = 3600
+)
+
+//DefaultHashVnodes 一致性hash环中每个storage默认的虚拟节点数
+const DefaultHashVnodes = 100
+
+//DefaultDecommissionPasses 下线任务复制阶段的最大轮数 超过后任务失败
+const DefaultDecommissionPasses = 10
+
+//跨group迁移的默认参数 触发迁移的剩余容量差比例、每轮迁移的最大数据量(MB)以及并发数
+const (
+	DefaultRebalanceThreshold   = 0.2
+	DefaultRebalanceMaxSize     = 1024
+	DefaultRebalanceConcurrency = 2
+)
+
+//tracker主动健康检查的默认参数 检查间隔、超时时间(秒)，连续成功rise次标记上线，连续失败fall次标记离线
+const (
+	DefaultHealthInterval = 5
+	DefaultHealthTimeout  = 2
+	DefaultHealthRise     = 2
+	DefaultHealthFall     = 3
+)
+
+//DefaultWriteTimeout 等待副本确认的默认超时时间 单位秒
+const DefaultWriteTimeout = 30
+
+//DefaultAntiEntropyInterval 副本一致性检查默认间隔 单位分钟
+const DefaultAntiEntropyInterval = 10
+
+//DefaultTombstoneExpire 删除记录的保留时间 单位小时 超过该时间离线的storage可能恢复已删除的文件
+const DefaultTombstoneExpire = 7 * 24
+
+//DefaultUploadExpire 未完成上传的默认过期时间 单位小时
+const DefaultUploadExpire = 24
+
 const DefaultFileDownloadContentType = "application/octet-stream"
 
 var FileContentType = map[string]string{
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"os"
 	"sync"
 )
 
@@ -33,6 +35,12 @@ func NewEggDB(name string) *EggDB {
 	return db
 }
 
+//IsExistDB db文件是否已存在
+func IsExistDB(name string) bool {
+	_, err := os.Stat(fmt.Sprintf("%s/%s", defaultDBDir, name))
+	return err == nil
+}
+
 func (db *EggDB) Get(key string) ([]byte, error) {
 	if key == "" {
 		return nil, errors.New("key can not be empty")
@@ -63,3 +71,27 @@ func (db *EggDB) Put(key string, value []byte) error {
 func (db *EggDB) IsExistKey(key string) (bool, error) {
 	return db.Ldb.Has([]byte(key), nil)
 }
+
+//Range 遍历前缀为prefix的键值对 fn返回false时停止遍历
+func (db *EggDB) Range(prefix string, fn func(key, value []byte) bool) error {
+	iter := db.Ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+//RangeFrom 从start开始按key顺序遍历 fn返回false时停止遍历
+func (db *EggDB) RangeFrom(start string, fn func(key, value []byte) bool) error {
+	iter := db.Ldb.NewIterator(&util.Range{Start: []byte(start)}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
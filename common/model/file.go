@@ -11,6 +11,157 @@ type FileInfo struct {
 	Group  string `json:"group"`
 }
 
+//FileRef 文件引用 相同内容的文件只保存一份，每次上传记录一个引用
+type FileRef struct {
+	FileId string `json:"file_id"`
+	Name   string `json:"name"`
+}
+
+type FileRefInfo struct {
+	Md5   string    `json:"md5"`
+	Count int       `json:"count"`
+	Refs  []FileRef `json:"refs"`
+}
+
+//CatalogEntry storage文件目录项 新节点全量同步时使用
+type CatalogEntry struct {
+	FileInfo
+	Refs []FileRef `json:"refs"`
+}
+
+type CatalogPage struct {
+	Total      int64           `json:"total"`
+	Files      []CatalogEntry  `json:"files"`
+	Tombstones []FileTombstone `json:"tombstones,omitempty"`
+}
+
+//FileTombstone 引用删除记录 用于区分副本缺少文件与副本未删除文件
+type FileTombstone struct {
+	Md5        string `json:"md5"`
+	FileId     string `json:"file_id"`
+	DeleteTime int64  `json:"delete_time"`
+}
+
+//CatalogSummary 按md5前两位分桶的文件目录摘要
+type CatalogSummary struct {
+	Root    string   `json:"root"`
+	Buckets []string `json:"buckets"`
+}
+
+//AntiEntropyInfo 副本一致性检查结果
+type AntiEntropyInfo struct {
+	Root      string `json:"root"`
+	Peers     int    `json:"peers"`
+	Divergent int    `json:"divergent"` //与peer不一致的桶数
+	Added     int64  `json:"added"`
+	Removed   int64  `json:"removed"`
+	Failed    int64  `json:"failed"`
+	LastError string `json:"last_error"`
+	RunTime   int64  `json:"run_time"`
+}
+
+//Decommission storage或group下线任务
+//复制阶段检查源文件目录中的每个文件并补齐副本，校验阶段只检查，全部满足副本数后才移除storage
+type Decommission struct {
+	Id         string `json:"id"`
+	Group      string `json:"group"`
+	Addr       string `json:"addr,omitempty"`   //为空时下线整个group
+	Target     string `json:"target,omitempty"` //下线group时文件迁移的目标group
+	Replicas   int    `json:"replicas"`         //每个文件在其他storage上需要的副本数
+	State      string `json:"state"`
+	Source     string `json:"source"` //读取文件目录的storage
+	Cursor     string `json:"cursor"` //已处理的最后一个md5
+	Pass       int    `json:"pass"`   //已完成的复制轮数
+	Total      int64  `json:"total"`
+	Checked    int64  `json:"checked"`
+	Copied     int64  `json:"copied"`
+	Missing    int64  `json:"missing"` //本轮未能满足副本数的文件数
+	LastError  string `json:"last_error,omitempty"`
+	CreateTime int64  `json:"create_time"`
+	UpdateTime int64  `json:"update_time"`
+}
+
+//RebalanceMove 跨group迁移的文件
+type RebalanceMove struct {
+	Md5  string    `json:"md5"`
+	Path string    `json:"path"`
+	Size int64     `json:"size"`
+	Refs []FileRef `json:"refs"`
+	Src  string    `json:"src"` //读取文件的storage
+}
+
+//RebalancePlan 跨group迁移计划 从剩余容量最小的group迁移到剩余容量最大的group
+type RebalancePlan struct {
+	Source string          `json:"source"`
+	Target string          `json:"target"`
+	Bytes  int64           `json:"bytes"`
+	Moves  []RebalanceMove `json:"moves"`
+}
+
+//RebalanceStatus 跨group迁移进度
+type RebalanceStatus struct {
+	Running   bool   `json:"running"`
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Planned   int    `json:"planned"`
+	Moved     int    `json:"moved"`
+	Failed    int    `json:"failed"`
+	Bytes     int64  `json:"bytes"`  //已迁移的数据量
+	Cursor    int    `json:"cursor"` //已完成的迁移数 leader切换或重启后从此处继续
+	LastError string `json:"last_error,omitempty"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time,omitempty"`
+}
+
+//RebalanceTask 持久化的跨group迁移计划与进度
+type RebalanceTask struct {
+	Plan   RebalancePlan   `json:"plan"`
+	Status RebalanceStatus `json:"status"`
+}
+
+//FileRedirect 迁移后文件所在的group与路径
+type FileRedirect struct {
+	Group string `json:"group"`
+	Path  string `json:"path"`
+}
+
+//ApiKey api key 密钥只在创建时返回
+type ApiKey struct {
+	Id         string `json:"id"`
+	Secret     string `json:"secret,omitempty"`
+	Role       string `json:"role"`
+	Static     bool   `json:"static,omitempty"` //配置文件中的key
+	CreateTime int64  `json:"create_time,omitempty"`
+}
+
+//SignedUrl 签名下载地址
+type SignedUrl struct {
+	Url    string `json:"url"`
+	Group  string `json:"group"`
+	Path   string `json:"path"`
+	Expire int64  `json:"expire"`
+	Ip     string `json:"ip,omitempty"` //绑定的客户端ip
+}
+
+//GroupAccess group访问模式
+type GroupAccess struct {
+	Group   string `json:"group"`
+	Access  string `json:"access"`
+	Default bool   `json:"default"` //未单独设置 使用default_access
+}
+
+//BootstrapInfo 新节点全量同步进度
+type BootstrapInfo struct {
+	State      string `json:"state"`
+	Peer       string `json:"peer"`
+	Total      int64  `json:"total"`
+	Done       int64  `json:"done"`
+	Failed     int64  `json:"failed"`
+	LastError  string `json:"last_error"`
+	StartTime  int64  `json:"start_time"`
+	UpdateTime int64  `json:"update_time"`
+}
+
 type SyncFileInfo struct {
 	Src      string `json:"src"`
 	Dst      string `json:"dst"`
@@ -20,4 +171,55 @@ type SyncFileInfo struct {
 	FileHash string `json:"file_hash"`
 	Action   string `json:"action"`
 	Group    string `json:"group"`
+	SrcGroup string `json:"src_group,omitempty"` //跨group迁移时源storage所在的group
+}
+
+type ChunkUploadInfo struct {
+	UploadId   string `json:"upload_id"`
+	FileName   string `json:"file_name"`
+	FilePath   string `json:"file_path"`
+	Size       int64  `json:"size"`
+	PartSize   int64  `json:"part_size"`
+	TotalParts int    `json:"total_parts"`
+	Md5        string `json:"md5"`
+	CreateTime int64  `json:"create_time"`
+	UpdateTime int64  `json:"update_time"` //最近一次上传分片的时间
+}
+
+type ChunkPartInfo struct {
+	UploadId string `json:"upload_id"`
+	Part     int    `json:"part"`
+	Size     int64  `json:"size"`
+	Md5      string `json:"md5"`
+}
+
+type ResumableUploadInfo struct {
+	UploadId   string `json:"upload_id"`
+	FileName   string `json:"file_name"`
+	FilePath   string `json:"file_path"`
+	Size       int64  `json:"size"`
+	Offset     int64  `json:"offset"`
+	Md5        string `json:"md5"`
+	CreateTime int64  `json:"create_time"`
+	UpdateTime int64  `json:"update_time"`
+}
+
+//UploadRoute 上传会话与storage的对应关系
+type UploadRoute struct {
+	Group      string `json:"group"`
+	Addr       string `json:"addr"`
+	UpdateTime int64  `json:"update_time"`
+}
+
+//SyncTask 同步队列任务
+type SyncTask struct {
+	Id         string       `json:"id"`
+	FileKey    string       `json:"file_key"`
+	Info       SyncFileInfo `json:"info"`
+	State      string       `json:"state"`
+	Attempts   int          `json:"attempts"`
+	NextRetry  int64        `json:"next_retry"`
+	LastError  string       `json:"last_error"`
+	CreateTime int64        `json:"create_time"`
+	UpdateTime int64        `json:"update_time"`
 }
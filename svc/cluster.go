@@ -0,0 +1,267 @@
+package svc
+
+import (
+	"bufio"
+	"eggdfs/common/model"
+	"encoding/json"
+	"errors"
+	"github.com/hashicorp/raft"
+	"io"
+)
+
+//tracker集群共享状态
+//groups与storage成员、同步队列、上传会话等共享状态的修改都以Command的形式提交，
+//单节点时直接应用，raft集群时由leader复制到所有tracker后应用，follower的写入转发到leader。
+//storage的心跳数据只记录在收到心跳的tracker，只有注册与leader判定的状态变化经集群提交，应用修改时不读取本地检查状态与时钟
+
+const (
+	cmdPut     = "put"
+	cmdDelete  = "delete"
+	cmdStorage = "storage"
+	//cmdStorageAttr 设置storage属性
+	cmdStorageAttr = "storage_attr"
+	//cmdStorageRemove 移除下线的storage
+	cmdStorageRemove = "storage_remove"
+	//cmdStorageStatus leader判定的storage状态变化
+	cmdStorageStatus = "storage_status"
+)
+
+//Command 共享状态的修改
+type Command struct {
+	Op      string         `json:"op"`
+	DB      string         `json:"db,omitempty"`
+	Keys    []string       `json:"keys,omitempty"`
+	Value   []byte         `json:"value,omitempty"`
+	Storage *StorageServer `json:"storage,omitempty"`
+}
+
+//Consensus 共享状态的提交方式
+type Consensus interface {
+	//Apply 提交修改 返回时本节点已应用该修改
+	Apply(cmd *Command) error
+	//IsLeader 是否执行后台任务的节点
+	IsLeader() bool
+	//Status 集群状态
+	Status() map[string]interface{}
+}
+
+//KVStore 键值存储
+type KVStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(keys ...string) error
+	Range(prefix string, fn func(key, value []byte) bool) error
+}
+
+//replicatedDB 共享的EggDB 读取本地数据，写入经Consensus提交
+type replicatedDB struct {
+	name string
+	db   *model.EggDB
+	t    *Tracker
+}
+
+func (t *Tracker) newReplicatedDB(name string) *replicatedDB {
+	db := &replicatedDB{name: name, db: model.NewEggDB(name), t: t}
+	t.dbs[name] = db.db
+	return db
+}
+
+func (r *replicatedDB) Get(key string) ([]byte, error) {
+	return r.db.Get(key)
+}
+
+func (r *replicatedDB) Range(prefix string, fn func(key, value []byte) bool) error {
+	return r.db.Range(prefix, fn)
+}
+
+func (r *replicatedDB) Put(key string, value []byte) error {
+	if key == "" {
+		return errors.New("key can not be empty")
+	}
+	return r.t.cluster.Apply(&Command{Op: cmdPut, DB: r.name, Keys: []string{key}, Value: value})
+}
+
+func (r *replicatedDB) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.t.cluster.Apply(&Command{Op: cmdDelete, DB: r.name, Keys: keys})
+}
+
+//applyCommand 应用共享状态的修改
+func (t *Tracker) applyCommand(cmd *Command) error {
+	switch cmd.Op {
+	case cmdPut, cmdDelete:
+		db, ok := t.dbs[cmd.DB]
+		if !ok {
+			return errors.New("no such db: " + cmd.DB)
+		}
+		if cmd.Op == cmdDelete {
+			return db.Delete(cmd.Keys...)
+		}
+		if len(cmd.Keys) != 1 {
+			return errors.New("put requires one key")
+		}
+		return db.Put(cmd.Keys[0], cmd.Value)
+	case cmdStorage:
+		if cmd.Storage == nil {
+			return errors.New("nil storage")
+		}
+		return t.applyStorage(cmd.Storage)
+	case cmdStorageAttr:
+		if cmd.Storage == nil {
+			return errors.New("nil storage")
+		}
+		return t.applyStorageAttr(cmd.Storage)
+	case cmdStorageRemove:
+		if cmd.Storage == nil {
+			return errors.New("nil storage")
+		}
+		return t.applyStorageRemove(cmd.Storage)
+	case cmdStorageStatus:
+		if cmd.Storage == nil {
+			return errors.New("nil storage")
+		}
+		return t.applyStorageStatus(cmd.Storage)
+	}
+	return errors.New("unknown command: " + cmd.Op)
+}
+
+//localConsensus 单节点 直接应用修改
+type localConsensus struct {
+	t *Tracker
+}
+
+func (lc *localConsensus) Apply(cmd *Command) error {
+	return lc.t.applyCommand(cmd)
+}
+
+func (lc *localConsensus) IsLeader() bool {
+	return true
+}
+
+func (lc *localConsensus) Status() map[string]interface{} {
+	return map[string]interface{}{"mode": "standalone"}
+}
+
+//trackerFSM raft状态机
+type trackerFSM struct {
+	t *Tracker
+}
+
+func (f *trackerFSM) Apply(log *raft.Log) interface{} {
+	var cmd Command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return err
+	}
+	return f.t.applyCommand(&cmd)
+}
+
+//snapshotRecord 快照中的一条记录 db记录或group
+type snapshotRecord struct {
+	DB    string `json:"db,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Group *Group `json:"group,omitempty"`
+}
+
+type trackerSnapshot struct {
+	records []snapshotRecord
+}
+
+//Snapshot 复制当前的共享状态
+func (f *trackerFSM) Snapshot() (raft.FSMSnapshot, error) {
+	records := make([]snapshotRecord, 0)
+	for name, db := range f.t.dbs {
+		_ = db.Range("", func(key, value []byte) bool {
+			records = append(records, snapshotRecord{
+				DB:    name,
+				Key:   string(key),
+				Value: append([]byte(nil), value...),
+			})
+			return true
+		})
+	}
+	f.t.lock.Lock()
+	for _, g := range f.t.GetGroups() {
+		data, err := json.Marshal(g)
+		if err != nil {
+			continue
+		}
+		var group Group
+		_ = json.Unmarshal(data, &group)
+		records = append(records, snapshotRecord{Group: &group})
+	}
+	f.t.lock.Unlock()
+	return &trackerSnapshot{records: records}, nil
+}
+
+//Restore 用快照替换共享状态
+func (f *trackerFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	for _, db := range f.t.dbs {
+		keys := make([]string, 0)
+		_ = db.Range("", func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		if err := db.Delete(keys...); err != nil {
+			return err
+		}
+	}
+	groups := make(map[string]*Group)
+	dec := json.NewDecoder(bufio.NewReader(rc))
+	for {
+		var r snapshotRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if r.Group != nil {
+			if r.Group.Storages == nil {
+				r.Group.Storages = make(map[string]*StorageServer)
+			}
+			groups[r.Group.Name] = r.Group
+			continue
+		}
+		if db, ok := f.t.dbs[r.DB]; ok {
+			if err := db.Put(r.Key, r.Value); err != nil {
+				return err
+			}
+		}
+	}
+	//心跳数据不属于共享状态 保留本节点收到的心跳
+	for _, g := range groups {
+		if cur := f.t.GetGroup(g.Name); cur != nil {
+			for _, s := range g.Storages {
+				if old := cur.GetStorage(s.Addr); old != nil {
+					s.setReport(old)
+				}
+			}
+		}
+	}
+	f.t.mu.Lock()
+	f.t.groups = groups
+	f.t.mu.Unlock()
+	f.t.persistGroups()
+	return nil
+}
+
+func (s *trackerSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	enc := json.NewEncoder(w)
+	for i := range s.records {
+		if err := enc.Encode(&s.records[i]); err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *trackerSnapshot) Release() {}
@@ -0,0 +1,269 @@
+package svc
+
+import (
+	"crypto/tls"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/svc/conf"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//tracker raft集群
+//配置tracker.cluster后启用，各tracker首次启动时以相同的成员配置初始化集群
+
+const (
+	raftApplyTimeout = 5 * time.Second
+	raftSnapshotDir  = "./data/raft-snapshot"
+)
+
+type raftConsensus struct {
+	t     *Tracker
+	raft  *raft.Raft
+	self  conf.TrackerNode
+	nodes []conf.TrackerNode
+}
+
+//newConsensus 配置了集群时启动raft，否则单节点运行
+func newConsensus(t *Tracker) Consensus {
+	c := config().Tracker
+	if len(c.Cluster) == 0 {
+		return &localConsensus{t: t}
+	}
+	rc, err := newRaftConsensus(t, c.RaftId, c.Cluster)
+	if err != nil {
+		logger.Panic("raft启动失败 " + err.Error())
+	}
+	return rc
+}
+
+func newRaftConsensus(t *Tracker, id string, nodes []conf.TrackerNode) (*raftConsensus, error) {
+	rc := &raftConsensus{t: t, nodes: nodes}
+	for _, n := range nodes {
+		if n.Id == id {
+			rc.self = n
+		}
+	}
+	if rc.self.Id == "" {
+		return nil, errors.New("raft_id not in cluster: " + id)
+	}
+
+	rconf := raft.DefaultConfig()
+	rconf.LocalID = raft.ServerID(rc.self.Id)
+	rconf.LogOutput = raftLogWriter{}
+	rconf.LogLevel = "WARN"
+
+	store := newRaftStore()
+	snaps, err := raft.NewFileSnapshotStore(raftSnapshotDir, 2, raftLogWriter{})
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", rc.self.Raft)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := newRaftTransport(rc.self.Raft, addr)
+	if err != nil {
+		return nil, err
+	}
+	rc.raft, err = raft.NewRaft(rconf, &trackerFSM{t: t}, store, store, snaps, trans)
+	if err != nil {
+		return nil, err
+	}
+
+	exist, err := raft.HasExistingState(store, store, snaps)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		servers := make([]raft.Server, 0, len(nodes))
+		for _, n := range nodes {
+			servers = append(servers, raft.Server{ID: raft.ServerID(n.Id), Address: raft.ServerAddress(n.Raft)})
+		}
+		if err = rc.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+//Apply leader直接提交，follower转发到leader并等待本节点应用
+func (rc *raftConsensus) Apply(cmd *Command) error {
+	if rc.IsLeader() {
+		_, err := rc.applyLeader(cmd)
+		return err
+	}
+	leader := rc.leaderHttp()
+	if leader == "" {
+		return errors.New("no raft leader")
+	}
+	resp, err := util.HttpPost(leader+"/raft/apply", cmd, nil, raftApplyTimeout)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Data    uint64 `json:"data"`
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return err
+	}
+	if res.Status != common.Success {
+		return errors.New("raft apply fail: " + res.Message)
+	}
+	//等待本节点应用，保证follower随后的读取能看到该修改
+	deadline := time.Now().Add(raftApplyTimeout)
+	for rc.raft.AppliedIndex() < res.Data {
+		if time.Now().After(deadline) {
+			return errors.New("raft apply timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+//applyLeader leader提交修改 返回日志index
+func (rc *raftConsensus) applyLeader(cmd *Command) (uint64, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return 0, err
+	}
+	f := rc.raft.Apply(data, raftApplyTimeout)
+	if err = f.Error(); err != nil {
+		return 0, err
+	}
+	if err, ok := f.Response().(error); ok && err != nil {
+		return 0, err
+	}
+	return f.Index(), nil
+}
+
+func (rc *raftConsensus) IsLeader() bool {
+	return rc.raft.State() == raft.Leader
+}
+
+//leaderHttp leader的http地址
+func (rc *raftConsensus) leaderHttp() string {
+	leader := string(rc.raft.Leader())
+	for _, n := range rc.nodes {
+		if n.Raft == leader {
+			return strings.TrimSuffix(n.Http, "/")
+		}
+	}
+	return ""
+}
+
+func (rc *raftConsensus) Status() map[string]interface{} {
+	return map[string]interface{}{
+		"mode":          "raft",
+		"id":            rc.self.Id,
+		"state":         rc.raft.State().String(),
+		"leader":        rc.leaderHttp(),
+		"applied_index": rc.raft.AppliedIndex(),
+		"nodes":         rc.nodes,
+	}
+}
+
+//RaftApply api follower转发的修改 只有leader处理
+func (t *Tracker) RaftApply(c *gin.Context) {
+	rc, ok := t.cluster.(*raftConsensus)
+	if !ok || !rc.IsLeader() {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: "not raft leader",
+		})
+		return
+	}
+	var cmd Command
+	if err := c.ShouldBindJSON(&cmd); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	index, err := rc.applyLeader(&cmd)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   index,
+	})
+}
+
+//ClusterStatus api tracker集群状态
+func (t *Tracker) ClusterStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   t.cluster.Status(),
+	})
+}
+
+//raftLogWriter raft日志写入zap
+type raftLogWriter struct{}
+
+func (raftLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	switch {
+	case strings.Contains(msg, "[ERROR]"):
+		logger.Error(msg)
+	case strings.Contains(msg, "[WARN]"):
+		logger.Warn(msg)
+	default:
+		logger.Info(msg)
+	}
+	return len(p), nil
+}
+
+//newRaftTransport raft通信 配置了cluster_ca、cluster_cert与cluster_key时使用双向认证的tls
+func newRaftTransport(bind string, advertise net.Addr) (raft.Transport, error) {
+	c := config()
+	if c.ClusterCA == "" || c.ClusterCert == "" || c.ClusterKey == "" {
+		return raft.NewTCPTransport(bind, advertise, 3, 10*time.Second, raftLogWriter{})
+	}
+	cfg, err := util.ClusterTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	//raft只信任集群ca
+	if cfg.RootCAs, err = util.LoadCertPool(c.ClusterCA); err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = cfg.RootCAs
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	layer := &tlsStreamLayer{Listener: tls.NewListener(ln, cfg), advertise: advertise, config: cfg}
+	return raft.NewNetworkTransport(layer, 3, 10*time.Second, raftLogWriter{}), nil
+}
+
+//tlsStreamLayer tls连接的raft.StreamLayer
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	config    *tls.Config
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), l.config)
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 	"io"
@@ -23,11 +24,74 @@ type GlobalConfig struct {
 	Host       string `mapstructure:"host"`
 	Port       string `mapstructure:"port"`
 	LogDir     string `mapstructure:"log_dir"`
+	//未完成上传的过期时间 单位小时
+	UploadExpire int64 `mapstructure:"upload_expire"`
+	//重定向下载签名密钥 tracker与storage需一致 为空时不签名
+	RedirectSecret string `mapstructure:"redirect_secret"`
+	//节点间认证 tracker与storage之间的请求使用集群密钥签名，
+	//配置cluster_ca后同时接受该ca签发的客户端证书，cluster_cert与cluster_key为本节点发起请求时出示的证书 均为空时不认证
+	ClusterSecret string `mapstructure:"cluster_secret"`
+	ClusterCA     string `mapstructure:"cluster_ca"`
+	ClusterCert   string `mapstructure:"cluster_cert"`
+	ClusterKey    string `mapstructure:"cluster_key"`
+
+	//http_schema为https时使用的证书与私钥、最低版本(1.2||1.3 默认1.2)、校验客户端证书的ca，
+	//以及节点间https请求信任的ca 为空时使用系统ca 文件修改后自动重新加载
+	TLS struct {
+		Cert       string `mapstructure:"cert"`
+		Key        string `mapstructure:"key"`
+		MinVersion string `mapstructure:"min_version"`
+		ClientCA   string `mapstructure:"client_ca"`
+		CABundle   string `mapstructure:"ca_bundle"`
+	} `json:"tls"`
 
 	//tracker配置
 	Tracker struct {
 		NodeId        int64 `mapstructure:"node_id"`
 		EnableTmpFile bool  `mapstructure:"enable_tmp_file"`
+		ProxyAttempts int   `mapstructure:"proxy_attempts"`
+		//下载方式 proxy:经tracker代理 redirect:重定向到storage静态地址
+		DownloadMode     string `mapstructure:"download_mode"`
+		RedirectStatus   int    `mapstructure:"redirect_status"`
+		RedirectTokenTTL int64  `mapstructure:"redirect_token_ttl"`
+		//签名下载地址默认以及最大有效期 单位秒
+		SignedUrlTTL    int64 `mapstructure:"signed_url_ttl"`
+		SignedUrlMaxTTL int64 `mapstructure:"signed_url_max_ttl"`
+		//未单独设置的group的访问模式 public||private 默认public
+		DefaultAccess string `mapstructure:"default_access"`
+		//同步任务最大尝试次数以及指数退避的初始、最大间隔 单位秒
+		SyncMaxAttempts int   `mapstructure:"sync_max_attempts"`
+		SyncRetryBase   int64 `mapstructure:"sync_retry_base"`
+		SyncRetryMax    int64 `mapstructure:"sync_retry_max"`
+		//默认写入级别 ONE||QUORUM||ALL 以及等待副本确认的超时时间 单位秒
+		WriteConcern string `mapstructure:"write_concern"`
+		WriteTimeout int64  `mapstructure:"write_timeout"`
+		//上传group选择策略 max_free||round_robin||weighted||header
+		GroupSelector string `mapstructure:"group_selector"`
+		//group内storage选择策略 上传与下载分别配置 consistent_hash||round_robin||least_inflight||weighted
+		UploadSelector   string `mapstructure:"upload_selector"`
+		DownloadSelector string `mapstructure:"download_selector"`
+		//一致性hash环中每个storage的虚拟节点数
+		HashVnodes int `mapstructure:"hash_vnodes"`
+		//跨group迁移 自动执行间隔(分钟 为0时只能手动执行)、触发迁移的剩余容量差比例、每轮最大数据量(MB)、带宽(MB/s 为0时不限制)以及并发数
+		RebalanceInterval    int     `mapstructure:"rebalance_interval"`
+		RebalanceThreshold   float64 `mapstructure:"rebalance_threshold"`
+		RebalanceMaxSize     int64   `mapstructure:"rebalance_max_size"`
+		RebalanceBandwidth   int64   `mapstructure:"rebalance_bandwidth"`
+		RebalanceConcurrency int     `mapstructure:"rebalance_concurrency"`
+		//主动健康检查 检查间隔(秒 小于0时关闭)、超时时间(秒)，连续成功health_rise次标记上线，连续失败health_fall次标记离线
+		HealthInterval int64 `mapstructure:"health_interval"`
+		HealthTimeout  int64 `mapstructure:"health_timeout"`
+		HealthRise     int   `mapstructure:"health_rise"`
+		HealthFall     int   `mapstructure:"health_fall"`
+		//api key认证 开启后请求需携带hmac签名 auth_skew为签名时间戳允许的误差(秒) auth_body_max为校验前暂存请求体的最大长度(MB) api_keys为配置文件中的key
+		AuthEnable  bool     `mapstructure:"auth_enable"`
+		AuthSkew    int64    `mapstructure:"auth_skew"`
+		AuthBodyMax int64    `mapstructure:"auth_body_max"`
+		ApiKeys     []ApiKey `mapstructure:"api_keys"`
+		//raft集群 为空时单节点运行 raft_id为本节点在cluster中的id
+		RaftId  string        `mapstructure:"raft_id"`
+		Cluster []TrackerNode `mapstructure:"cluster"`
 	} `json:"tracker"`
 
 	//storage配置
@@ -35,10 +99,30 @@ type GlobalConfig struct {
 		Group         string   `mapstructure:"group"`
 		FileSizeLimit int64    `mapstructure:"file_size_limit"`
 		StorageDir    string   `mapstructure:"storage_dir"`
+		TmpDir        string   `mapstructure:"tmp_dir"`
 		Trackers      []string `mapstructure:"trackers"`
+
+		//只允许携带tracker重定向签名的下载请求
+		RequireRedirectToken bool `mapstructure:"require_redirect_token"`
+		//副本一致性检查间隔 单位分钟 小于0时关闭
+		AntiEntropyInterval int `mapstructure:"anti_entropy_interval"`
 	} `json:"storage"`
 }
 
+//TrackerNode raft集群中的tracker节点
+type TrackerNode struct {
+	Id   string `mapstructure:"id" json:"id"`
+	Raft string `mapstructure:"raft" json:"raft"` //raft通信地址 host:port
+	Http string `mapstructure:"http" json:"http"` //tracker访问地址
+}
+
+//ApiKey 配置文件中的api key 不能通过接口删除
+type ApiKey struct {
+	Id     string `mapstructure:"id" json:"id"`
+	Secret string `mapstructure:"secret" json:"secret"`
+	Role   string `mapstructure:"role" json:"role"` //read||write||admin
+}
+
 //parseConfig 解析配置文件
 func parseConfig() {
 	v := viper.New()
@@ -58,10 +142,30 @@ func parseConfig() {
 	if err != nil {
 		panic("parse config file error,please check config")
 	}
+	if err = c.Validate(); err != nil {
+		panic("invalid config: " + err.Error())
+	}
 	//并发安全，指针赋值
 	atomic.StorePointer(&configPtr, unsafe.Pointer(&c))
 }
 
+//Validate 校验配置项之间的依赖
+func (c *GlobalConfig) Validate() error {
+	switch c.Tracker.DefaultAccess {
+	case "", "public":
+	case "private":
+		if c.RedirectSecret == "" {
+			return errors.New("tracker.default_access private requires redirect_secret")
+		}
+	default:
+		return errors.New("invalid tracker.default_access: " + c.Tracker.DefaultAccess)
+	}
+	if c.Storage.RequireRedirectToken && c.RedirectSecret == "" {
+		return errors.New("storage.require_redirect_token requires redirect_secret")
+	}
+	return nil
+}
+
 //Config 获取配置参数
 func Config() *GlobalConfig {
 	return (*GlobalConfig)(atomic.LoadPointer(&configPtr))
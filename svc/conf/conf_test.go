@@ -9,3 +9,27 @@ func TestParseConfig(t *testing.T) {
 	parseConfig()
 	fmt.Printf("%+v", Config())
 }
+
+func TestValidate(t *testing.T) {
+	c := GlobalConfig{}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Tracker.DefaultAccess = "private"
+	if c.Validate() == nil {
+		t.Fatal("private access without redirect_secret")
+	}
+	c.RedirectSecret = "secret"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Tracker.DefaultAccess = "protected"
+	if c.Validate() == nil {
+		t.Fatal("invalid access")
+	}
+	c = GlobalConfig{}
+	c.Storage.RequireRedirectToken = true
+	if c.Validate() == nil {
+		t.Fatal("require_redirect_token without redirect_secret")
+	}
+}
@@ -1,6 +1,8 @@
 package svc
 
 import (
+	"eggdfs/common"
+	"eggdfs/common/model"
 	"errors"
 	"sort"
 	"sync"
@@ -15,12 +17,70 @@ type Group struct {
 }
 
 type StorageServer struct {
-	Group      string `json:"group"`
-	HttpSchema string `json:"http_schema"`
-	Addr       string `json:"addr"`
-	Status     int    `json:"status"`
-	Free       uint64 `json:"free"`
-	UpdateTime int64  `json:"update_time"`
+	Group       string                 `json:"group"`
+	HttpSchema  string                 `json:"http_schema"`
+	Addr        string                 `json:"addr"`
+	Status      int                    `json:"status"`
+	Free        uint64                 `json:"free"`
+	Files       int64                  `json:"files"`
+	Bootstrap   *model.BootstrapInfo   `json:"bootstrap,omitempty"`    //全量同步进度
+	AntiEntropy *model.AntiEntropyInfo `json:"anti_entropy,omitempty"` //最近一次副本一致性检查结果
+	Attr        StorageAttr            `json:"attr"`                   //运维设置的属性
+	UpdateTime  int64                  `json:"update_time"`
+}
+
+//StorageAttr 运维设置的storage属性 不随心跳更新，tracker重启后保留
+type StorageAttr struct {
+	Weight int `json:"weight,omitempty"` //选择权重 0为默认
+	State  int `json:"state,omitempty"`  //运维设置的状态 覆盖心跳计算的状态 0为不设置
+}
+
+//GroupDivergence group内副本一致性统计
+type GroupDivergence struct {
+	Group      string                            `json:"group"`
+	Consistent bool                              `json:"consistent"` //所有storage的文件目录摘要一致
+	Roots      int                               `json:"roots"`      //不同的文件目录摘要数
+	Divergent  int                               `json:"divergent"`  //最近一次检查中不一致的桶数
+	Added      int64                             `json:"added"`
+	Removed    int64                             `json:"removed"`
+	Failed     int64                             `json:"failed"`
+	Storages   map[string]*model.AntiEntropyInfo `json:"storages"`
+}
+
+//setReport 使用from的心跳数据 心跳数据由各tracker自行记录，不经集群提交
+func (s *StorageServer) setReport(from *StorageServer) {
+	s.Free, s.Files, s.UpdateTime = from.Free, from.Files, from.UpdateTime
+	s.Bootstrap, s.AntiEntropy = from.Bootstrap, from.AntiEntropy
+}
+
+//Servable storage是否可处理读取请求
+//等待心跳确认的storage同样参与读写，代理失败时切换副本并标记离线
+func (s *StorageServer) Servable() bool {
+	switch s.Status {
+	case common.StorageActive, common.StoragePending, common.StorageDraining, common.StorageReadOnly:
+		return true
+	}
+	return false
+}
+
+//Writable storage是否接受新的上传
+func (s *StorageServer) Writable() bool {
+	return s.Status == common.StorageActive || s.Status == common.StoragePending
+}
+
+//Replicable storage是否接受同步写入 排空中的storage仍接收副本，直到进入维护状态
+func (s *StorageServer) Replicable() bool {
+	return s.Status == common.StorageActive || s.Status == common.StorageDraining
+}
+
+//Writable group是否有接受新上传的storage
+func (g *Group) Writable() bool {
+	for _, s := range g.GetStorages() {
+		if s.Writable() {
+			return true
+		}
+	}
+	return false
 }
 
 //GetStorages 获取注册的storage节点 map无法保证顺序
@@ -49,6 +109,16 @@ func (g *Group) GetStorage(addr string) *StorageServer {
 	return nil
 }
 
+//NextStorage 获取一个不在exclude中且usable的storage
+func (g *Group) NextStorage(exclude map[string]bool, usable func(*StorageServer) bool) *StorageServer {
+	for _, s := range g.GetStorages() {
+		if usable(s) && !exclude[s.Addr] {
+			return s
+		}
+	}
+	return nil
+}
+
 //RegisterStorage 注册storage节点
 func (g *Group) RegisterStorage(s *StorageServer) error {
 	if s.Addr == "" {
@@ -122,3 +192,41 @@ func (g *Group) GetGroupCap() uint64 {
 	})
 	return caps[0]
 }
+
+//BootstrapPeer 选择全量同步的源storage 取文件数最多的可用storage
+func (g *Group) BootstrapPeer(exclude string) *StorageServer {
+	var peer *StorageServer
+	for _, s := range g.GetStorages() {
+		if s.Addr == exclude || s.Status != common.StorageActive {
+			continue
+		}
+		if peer == nil || s.Files > peer.Files {
+			peer = s
+		}
+	}
+	return peer
+}
+
+//Divergence 汇总未离线storage最近一次的副本一致性检查结果
+func (g *Group) Divergence() GroupDivergence {
+	d := GroupDivergence{
+		Group:    g.Name,
+		Storages: make(map[string]*model.AntiEntropyInfo),
+	}
+	roots := make(map[string]bool)
+	for _, s := range g.GetStorages() {
+		if s.Status == common.StorageOffline || s.AntiEntropy == nil {
+			continue
+		}
+		info := s.AntiEntropy
+		d.Storages[s.Addr] = info
+		roots[info.Root] = true
+		d.Divergent += info.Divergent
+		d.Added += info.Added
+		d.Removed += info.Removed
+		d.Failed += info.Failed
+	}
+	d.Roots = len(roots)
+	d.Consistent = d.Roots <= 1
+	return d
+}
@@ -0,0 +1,152 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//GroupSelector 选择上传的group groups为可用的group 按名称排序且不为空
+type GroupSelector interface {
+	Select(r *http.Request, groups []*Group) (*Group, error)
+}
+
+//GroupSelectorFunc 函数形式的GroupSelector
+type GroupSelectorFunc func(r *http.Request, groups []*Group) (*Group, error)
+
+func (f GroupSelectorFunc) Select(r *http.Request, groups []*Group) (*Group, error) {
+	return f(r, groups)
+}
+
+//NewGroupSelector 根据策略名称创建GroupSelector 为空时使用max_free
+func NewGroupSelector(strategy string) (GroupSelector, error) {
+	switch strategy {
+	case "", common.GroupSelectMaxFree:
+		return MaxFreeGroupSelector{}, nil
+	case common.GroupSelectRoundRobin:
+		return &RoundRobinGroupSelector{}, nil
+	case common.GroupSelectWeighted:
+		return NewWeightedGroupSelector(), nil
+	case common.GroupSelectHeader:
+		return HeaderGroupSelector{Fallback: MaxFreeGroupSelector{}}, nil
+	}
+	return nil, errors.New("unknown group selector: " + strategy)
+}
+
+//MaxFreeGroupSelector 选择剩余容量最大的group
+type MaxFreeGroupSelector struct{}
+
+func (MaxFreeGroupSelector) Select(r *http.Request, groups []*Group) (*Group, error) {
+	g := groups[0]
+	for _, group := range groups[1:] {
+		if group.Cap > g.Cap {
+			g = group
+		}
+	}
+	return g, nil
+}
+
+//RoundRobinGroupSelector 轮询选择group
+type RoundRobinGroupSelector struct {
+	next uint64
+}
+
+func (s *RoundRobinGroupSelector) Select(r *http.Request, groups []*Group) (*Group, error) {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return groups[n%uint64(len(groups))], nil
+}
+
+//WeightedGroupSelector 按剩余容量加权随机选择group
+type WeightedGroupSelector struct {
+	rand *lockedRand
+}
+
+func NewWeightedGroupSelector() *WeightedGroupSelector {
+	return &WeightedGroupSelector{rand: newLockedRand()}
+}
+
+func (s *WeightedGroupSelector) Select(r *http.Request, groups []*Group) (*Group, error) {
+	var total uint64
+	for _, g := range groups {
+		total += g.Cap
+	}
+	if total == 0 {
+		return groups[s.rand.Intn(len(groups))], nil
+	}
+	n := s.rand.Uint64n(total)
+	for _, g := range groups {
+		if n < g.Cap {
+			return g, nil
+		}
+		n -= g.Cap
+	}
+	return groups[len(groups)-1], nil
+}
+
+//HeaderGroupSelector 使用请求头Egg-Dfs-Group指定的group 未指定时使用Fallback
+type HeaderGroupSelector struct {
+	Fallback GroupSelector
+}
+
+func (s HeaderGroupSelector) Select(r *http.Request, groups []*Group) (*Group, error) {
+	name := ""
+	if r != nil {
+		name = r.Header.Get(common.HeaderGroup)
+	}
+	if name == "" {
+		if s.Fallback == nil {
+			return nil, errors.New("group header required")
+		}
+		return s.Fallback.Select(r, groups)
+	}
+	for _, g := range groups {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return nil, errors.New("group unavailable: " + name)
+}
+
+//activeGroups 接受新上传的group 按名称排序
+func (t *Tracker) activeGroups() []*Group {
+	gs := make([]*Group, 0)
+	for _, g := range t.GetGroups() {
+		if g.Status == common.GroupActive && g.Writable() {
+			gs = append(gs, g)
+		}
+	}
+	sort.Slice(gs, func(i, j int) bool {
+		return gs[i].Name < gs[j].Name
+	})
+	return gs
+}
+
+//lockedRand 并发安全的随机数
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Uint64n(n uint64) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n <= 1<<63-1 {
+		return uint64(l.r.Int63n(int64(n)))
+	}
+	return l.r.Uint64() % n
+}
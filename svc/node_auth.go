@@ -0,0 +1,116 @@
+package svc
+
+import (
+	"bytes"
+	"crypto/x509"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//节点间认证
+//配置cluster_secret或cluster_ca后，storage回报、错误日志、raft转发、文件同步以及文件目录等节点间接口
+//只接受携带有效集群签名或出示cluster_ca签发的客户端证书的请求，其他请求被拒绝并记录日志
+
+//maxNodeBody 节点间请求体的最大长度
+const maxNodeBody = 1 << 20
+
+var (
+	nodeNonces nonceCache
+
+	clusterCAOnce sync.Once
+	clusterCA     *x509.CertPool
+	clusterCAErr  error
+)
+
+//nodeAuthEnabled 是否开启节点间认证
+func nodeAuthEnabled() bool {
+	return config().ClusterSecret != "" || config().ClusterCA != ""
+}
+
+//NodeAuth 节点间接口的认证中间件
+func NodeAuth(c *gin.Context) {
+	if !nodeAuthEnabled() {
+		c.Next()
+		return
+	}
+	if err := verifyNode(c.Request); err != nil {
+		logger.Warn("node auth fail", zap.String("url", c.Request.URL.Path), zap.String("ip", c.ClientIP()), zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, model.RespResult{
+			Status:  common.AuthFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.Next()
+}
+
+//nodeRequest 请求是否携带节点凭证 用于其他认证方式前判断是否为节点间请求
+//只有携带集群签名或出示cluster_ca签发的证书的请求按节点间认证，其他客户端证书按api key或下载签名认证
+func nodeRequest(r *http.Request) bool {
+	if !nodeAuthEnabled() {
+		return false
+	}
+	return r.Header.Get(common.HeaderNodeSignature) != "" || verifyClientCert(r) == nil
+}
+
+//verifyNode 校验请求来自集群内的节点 客户端证书优先
+func verifyNode(r *http.Request) error {
+	certErr := verifyClientCert(r)
+	if certErr == nil {
+		return nil
+	}
+	secret := config().ClusterSecret
+	if secret == "" {
+		return certErr
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxNodeBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxNodeBody {
+		return errors.New("request body too large")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	nonce, expire, err := util.VerifyNodeRequest(r, secret, body, common.DefaultAuthSkew)
+	if err != nil {
+		return err
+	}
+	if !nodeNonces.add(nonce, expire, time.Now().Unix()) {
+		return errors.New("replayed request")
+	}
+	return nil
+}
+
+//verifyClientCert 校验客户端证书由cluster_ca签发
+func verifyClientCert(r *http.Request) error {
+	if config().ClusterCA == "" || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("missing node credential")
+	}
+	clusterCAOnce.Do(func() {
+		clusterCA, clusterCAErr = util.LoadCertPool(config().ClusterCA)
+	})
+	if clusterCAErr != nil {
+		return clusterCAErr
+	}
+	certs := r.TLS.PeerCertificates
+	opts := x509.VerifyOptions{
+		Roots:         clusterCA,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,130 @@
+package svc
+
+import (
+	"eggdfs/common/model"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//raftStore 基于leveldb的raft日志与元数据存储
+//log@{index big endian} -> raft.Log
+//stable@{key} -> value
+type raftStore struct {
+	db *model.EggDB
+}
+
+const (
+	raftLogPrefix    = "log@"
+	raftStablePrefix = "stable@"
+)
+
+var errRaftKeyNotFound = errors.New("not found") //raft根据错误信息判断key不存在
+
+func newRaftStore() *raftStore {
+	return &raftStore{db: model.NewEggDB("raft")}
+}
+
+func raftLogKey(index uint64) []byte {
+	key := make([]byte, len(raftLogPrefix)+8)
+	copy(key, raftLogPrefix)
+	binary.BigEndian.PutUint64(key[len(raftLogPrefix):], index)
+	return key
+}
+
+func raftLogIndex(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(raftLogPrefix):])
+}
+
+//FirstIndex 第一条日志的index 没有日志时返回0
+func (rs *raftStore) FirstIndex() (uint64, error) {
+	iter := rs.db.Ldb.NewIterator(util.BytesPrefix([]byte(raftLogPrefix)), nil)
+	defer iter.Release()
+	if iter.First() {
+		return raftLogIndex(iter.Key()), nil
+	}
+	return 0, iter.Error()
+}
+
+//LastIndex 最后一条日志的index 没有日志时返回0
+func (rs *raftStore) LastIndex() (uint64, error) {
+	iter := rs.db.Ldb.NewIterator(util.BytesPrefix([]byte(raftLogPrefix)), nil)
+	defer iter.Release()
+	if iter.Last() {
+		return raftLogIndex(iter.Key()), nil
+	}
+	return 0, iter.Error()
+}
+
+func (rs *raftStore) GetLog(index uint64, log *raft.Log) error {
+	data, err := rs.db.Ldb.Get(raftLogKey(index), nil)
+	if err == leveldb.ErrNotFound {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, log)
+}
+
+func (rs *raftStore) StoreLog(log *raft.Log) error {
+	return rs.StoreLogs([]*raft.Log{log})
+}
+
+func (rs *raftStore) StoreLogs(logs []*raft.Log) error {
+	batch := new(leveldb.Batch)
+	for _, log := range logs {
+		data, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		batch.Put(raftLogKey(log.Index), data)
+	}
+	return rs.db.Ldb.Write(batch, nil)
+}
+
+//DeleteRange 删除[min, max]范围内的日志
+func (rs *raftStore) DeleteRange(min, max uint64) error {
+	iter := rs.db.Ldb.NewIterator(&util.Range{Start: raftLogKey(min), Limit: raftLogKey(max + 1)}, nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return rs.db.Ldb.Write(batch, nil)
+}
+
+func (rs *raftStore) Set(key []byte, val []byte) error {
+	return rs.db.Ldb.Put(append([]byte(raftStablePrefix), key...), val, nil)
+}
+
+func (rs *raftStore) Get(key []byte) ([]byte, error) {
+	val, err := rs.db.Ldb.Get(append([]byte(raftStablePrefix), key...), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, errRaftKeyNotFound
+	}
+	return val, err
+}
+
+func (rs *raftStore) SetUint64(key []byte, val uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, val)
+	return rs.Set(key, buf)
+}
+
+func (rs *raftStore) GetUint64(key []byte) (uint64, error) {
+	val, err := rs.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, errors.New("invalid uint64 value")
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
@@ -3,12 +3,38 @@ package svc
 import (
 	"eggdfs/common"
 	"eggdfs/svc/conf"
+	"eggdfs/util"
+	"net/http"
+	"time"
 )
 
 func config() *conf.GlobalConfig {
 	return conf.Config()
 }
 
+//uploadExpire 未完成上传的过期时间
+func uploadExpire() time.Duration {
+	h := config().UploadExpire
+	if h <= 0 {
+		h = common.DefaultUploadExpire
+	}
+	return time.Duration(h) * time.Hour
+}
+
+//listenAndServe 启动http服务 http_schema为https时使用tls配置的证书
+func listenAndServe(handler http.Handler) error {
+	addr := ":" + config().Port
+	if config().HttpSchema != common.HttpsSchema {
+		return http.ListenAndServe(addr, handler)
+	}
+	cfg, err := util.TLSServerConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: cfg}
+	return srv.ListenAndServeTLS("", "")
+}
+
 func Start() {
 	if config() == nil {
 		conf.InitGlobalConfig()
@@ -18,6 +44,6 @@ func Start() {
 	case common.DeployTypeStorages:
 		NewStorage().Start()
 	case common.DeployTypeTracker:
-		NewTracker(nil).Start()
+		NewTracker(nil, nil).Start()
 	}
 }
@@ -1,11 +1,13 @@
 package svc
 
 import (
+	"crypto/md5"
 	"eggdfs/common"
 	"eggdfs/common/model"
 	"eggdfs/logger"
 	"eggdfs/svc/conf"
 	"eggdfs/util"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,40 +16,75 @@ import (
 	"github.com/shirou/gopsutil/v3/disk"
 	"go.uber.org/zap"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	storageDBFileName = "storage"
+	chunkDBFileName   = "chunk"
+	resumableDBName   = "resumable"
+	defaultTmpDir     = "./tmp"
 )
 
 type Storage struct {
-	db         *model.EggDB
-	httpSchema string
-	trackers   []string
+	db          *model.EggDB
+	indexDB     *model.EggDB //文件元数据索引
+	chunkDB     *model.EggDB //分片上传会话
+	resumableDB *model.EggDB //断点续传上传会话
+	httpSchema  string
+	trackers    []string
+	uploadLock  sync.Mutex
+	uploading   map[string]int //正在写入的上传 -1为独占 大于0为同时上传的分片数
+	metaLock    sync.Mutex     //文件引用计数
+	files       int64          //文件数 不含重复文件
+	bootstrap   *model.BootstrapInfo
+	antiEntropy *model.AntiEntropyInfo
+	bootLock    sync.Mutex   //全量同步进度与一致性检查结果
+	access      atomic.Value //tracker回复的group访问模式
 }
 
 type StorageStatus struct {
-	Group      string `json:"group"`
-	HttpSchema string `json:"http_schema"`
-	Host       string `json:"host"`
-	Port       string `json:"port"`
-	Free       uint64 `json:"free"`
+	Group       string                 `json:"group"`
+	HttpSchema  string                 `json:"http_schema"`
+	Host        string                 `json:"host"`
+	Port        string                 `json:"port"`
+	Free        uint64                 `json:"free"`
+	Files       int64                  `json:"files"`
+	Bootstrap   *model.BootstrapInfo   `json:"bootstrap,omitempty"`
+	AntiEntropy *model.AntiEntropyInfo `json:"anti_entropy,omitempty"`
+}
+
+//StorageHealth 健康检查的响应
+type StorageHealth struct {
+	Group string `json:"group"`
+	Free  uint64 `json:"free"`
+	Files int64  `json:"files"`
+}
+
+//StorageStatusReply tracker对status回报的响应
+type StorageStatusReply struct {
+	BootstrapPeer string `json:"bootstrap_peer"` //需要全量同步时的源storage
+	Access        string `json:"access"`         //group访问模式
 }
 
 func NewStorage() *Storage {
 	return &Storage{
-		db:         model.NewEggDB(storageDBFileName),
-		httpSchema: config().HttpSchema,
-		trackers:   config().Storage.Trackers,
+		db:          model.NewEggDB(storageDBFileName),
+		indexDB:     model.NewEggDB(indexDBFileName),
+		chunkDB:     model.NewEggDB(chunkDBFileName),
+		resumableDB: model.NewEggDB(resumableDBName),
+		httpSchema:  config().HttpSchema,
+		trackers:    config().Storage.Trackers,
+		uploading:   make(map[string]int),
 	}
 }
 
@@ -59,17 +96,35 @@ func hello(c *gin.Context) {
 	})
 }
 
+//Health api tracker主动探测 存储目录不可用时返回失败
+func (s *Storage) Health(c *gin.Context) {
+	stat, err := disk.Usage(config().Storage.StorageDir)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data: StorageHealth{
+			Group: config().Storage.Group,
+			Free:  stat.Free,
+			Files: atomic.LoadInt64(&s.files),
+		},
+	})
+}
+
 //QuickUpload 适合小文件
 func (s *Storage) QuickUpload(c *gin.Context) {
 	//用户自定义的存储文件夹
 	fileHash := c.GetHeader(common.HeaderFileHash)
 	logger.Info(fileHash)
-	//秒传 检查数据库是否存在相同的md5
+	//秒传 检查数据库是否存在相同的md5 存在时只记录引用
 	if fileHash != "" {
-		fi := model.FileInfo{}
-		if exist, _ := s.db.IsExistKey(fileHash); exist {
-			data, _ := s.db.Get(fileHash)
-			_ = json.Unmarshal(data, &fi)
+		if fi, err := s.addFileRef(fileHash, c.GetHeader(common.HeaderFileUUID), ""); err == nil {
+			setUploadResHeader(c, fi)
 			c.JSON(http.StatusOK, model.RespResult{
 				Status:  common.Success,
 				Message: "文件已存在，秒传成功",
@@ -79,9 +134,16 @@ func (s *Storage) QuickUpload(c *gin.Context) {
 		}
 	}
 
-	customDir := c.GetHeader(common.HeaderUploadFileDir)
-	filePath := util.GenFilePath(customDir)
-	baseDir := config().Storage.StorageDir + "/" + filePath
+	filePath, err := uploadFilePath(c)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	baseDir, err := storagePath(filePath)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
 	if _, err := os.Stat(baseDir); err != nil {
 		err := os.MkdirAll(baseDir, os.ModePerm)
 		p, _ := filepath.Abs(config().Storage.StorageDir)
@@ -123,7 +185,11 @@ func (s *Storage) QuickUpload(c *gin.Context) {
 	//文件名由雪花算法的服务器生成
 	uuid := c.GetHeader(common.HeaderFileUUID)
 	fileName := util.GenFileName(uuid, file.Filename)
-	fullPath := baseDir + "/" + fileName
+	fullPath, err := storageFilePath(filePath, fileName)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
 	md5hash, err := s.SaveQuickUploadedFile(file, fullPath, fileHash)
 	if err != nil {
 		c.JSON(http.StatusOK, model.RespResult{
@@ -142,11 +208,14 @@ func (s *Storage) QuickUpload(c *gin.Context) {
 		Size:   file.Size,
 		Group:  config().Storage.Group,
 	}
-	bytes, _ := json.Marshal(fi)
-	_ = s.db.Put(fi.Md5, bytes)
-	c.Writer.Header().Set(common.HeaderFileUploadRes, strconv.Itoa(common.Success))
-	c.Writer.Header().Set(common.HeaderFileHash, fi.Md5)
-	c.Writer.Header().Set(common.HeaderFilePath, filePath+"/"+fileName)
+	if fi, err = s.saveFileInfo(fi); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	setUploadResHeader(c, fi)
 	c.JSON(http.StatusOK, model.RespResult{
 		Status:  common.Success,
 		Message: "文件保存成功",
@@ -159,8 +228,12 @@ func (s *Storage) GenFileStaticUrl(basePath, filename string) (url string) {
 	c := config()
 	p := basePath + "/" + filename
 	//todo domain域名
-	url = fmt.Sprintf("%s://%s/%s/%s", s.httpSchema, net.JoinHostPort(c.Host, c.Port), c.Storage.Group, p)
-	return
+	return fileStaticUrl(s.httpSchema, net.JoinHostPort(c.Host, c.Port), c.Storage.Group, p)
+}
+
+//fileStaticUrl 拼接文件静态访问地址
+func fileStaticUrl(schema, addr, group, path string) string {
+	return fmt.Sprintf("%s://%s/%s/%s", schema, addr, group, path)
 }
 
 //SaveQuickUploadedFile 保存快传文件
@@ -203,7 +276,11 @@ func (s *Storage) Download(c *gin.Context) {
 		})
 		return
 	}
-	fullPath := config().Storage.StorageDir + "/" + filePath
+	fullPath, err := storagePath(filePath)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
 	if _, err := os.Stat(fullPath); err != nil {
 		c.JSON(http.StatusOK, model.RespResult{
 			Status:  common.Fail,
@@ -215,6 +292,9 @@ func (s *Storage) Download(c *gin.Context) {
 	if filename == "" {
 		filename = path.Base(filePath)
 	}
+	if etag := s.fileETag(filePath); etag != "" {
+		c.Writer.Header().Set("ETag", etag)
+	}
 	//对下载的文件重命名
 	c.Writer.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
 	c.Writer.Header().Add("Content-Type", util.GetFileContentType(path.Ext(filePath)))
@@ -225,10 +305,13 @@ func (s *Storage) Download(c *gin.Context) {
 func (s *Storage) Status() {
 	c := config()
 	status := &StorageStatus{
-		Group:      c.Storage.Group,
-		HttpSchema: s.httpSchema,
-		Host:       c.Host,
-		Port:       c.Port,
+		Group:       c.Storage.Group,
+		HttpSchema:  s.httpSchema,
+		Host:        c.Host,
+		Port:        c.Port,
+		Files:       atomic.LoadInt64(&s.files),
+		Bootstrap:   s.bootstrapInfo(),
+		AntiEntropy: s.antiEntropyInfo(),
 	}
 	if stat, err := disk.Usage(c.Storage.StorageDir); err != nil {
 		status.Free = 0
@@ -239,7 +322,21 @@ func (s *Storage) Status() {
 	for _, url := range s.trackers {
 		go func(url string) {
 			logger.Info("report to tracker", zap.String("tracker", url), zap.String("host", c.Host))
-			_, _ = util.HttpPost(url+"/status", status, nil, time.Second)
+			resp, err := util.HttpPost(url+"/status", status, nil, time.Second)
+			if err != nil {
+				return
+			}
+			var res struct {
+				Status int                `json:"status"`
+				Data   StorageStatusReply `json:"data"`
+			}
+			if json.Unmarshal(resp, &res) != nil || res.Status != common.Success {
+				return
+			}
+			s.setAccess(res.Data.Access)
+			if res.Data.BootstrapPeer != "" {
+				s.startBootstrap(res.Data.BootstrapPeer)
+			}
 		}(url)
 	}
 }
@@ -269,7 +366,26 @@ type SyncFunc func(model.SyncFileInfo, *gin.Context)
 
 //SyncFileAdd 文件新增同步函数
 func (s *Storage) SyncFileAdd(sync model.SyncFileInfo, c *gin.Context) {
-	base := config().Storage.StorageDir + "/" + sync.FilePath
+	//文件已存在时只同步引用
+	if sync.FileHash != "" {
+		if _, err := s.addFileRef(sync.FileHash, sync.FileId, ""); err == nil {
+			c.JSON(http.StatusOK, model.RespResult{
+				Status: common.Success,
+			})
+			return
+		}
+	}
+
+	base, err := storagePath(sync.FilePath)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	fullPath, err := storageFilePath(sync.FilePath, sync.FileName)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
 	if _, err := os.Stat(base); err != nil {
 		err := os.MkdirAll(base, os.ModePerm)
 		if err != nil {
@@ -281,39 +397,24 @@ func (s *Storage) SyncFileAdd(sync model.SyncFileInfo, c *gin.Context) {
 		}
 	}
 
-	//download file
-	url := fmt.Sprintf("%s/%s/%s/%s", sync.Src, sync.Group, sync.FilePath, sync.FileName)
-	logger.Info("sync-add:url", zap.String("url", url))
-	resp, err := http.Get(url)
-	if err != nil {
-		c.JSON(http.StatusOK, model.RespResult{
-			Status: common.Fail,
-		})
-		return
+	//download file 先写入临时文件并计算md5，校验通过后再移动到保存路径
+	srcGroup := sync.Group
+	if sync.SrcGroup != "" {
+		srcGroup = sync.SrcGroup
 	}
-	//if resp != nil {
-	//	//检查校验和
-	//	md5hash, _ := util.GenMD5(resp.Body)
-	//	if md5hash != sync.FileHash && sync.FileHash != "" {
-	//		//report todo
-	//		return
-	//	}
-	//}
-	fullPath := base + "/" + sync.FileName
-	f, err := os.Create(fullPath)
+	url := s.peerFileUrl(sync.Src, srcGroup, sync.FilePath+"/"+sync.FileName)
+	logger.Info("sync-add:url", zap.String("url", url))
+	hash, err := s.downloadSyncFile(url, fullPath, sync.FileHash)
 	if err != nil {
-		go s.TransErrorLogToTracker(common.DirCreateFail, "文件保存路径创建失败"+fullPath)
-		c.JSON(http.StatusOK, model.RespResult{
-			Status: common.DirCreateFail,
-		})
-		return
-	}
-	l, err := io.Copy(f, resp.Body)
-	defer f.Close()
-	if err != nil || l <= 0 {
-		go s.TransErrorLogToTracker(common.FileSaveFail, "文件同步保存失败"+fullPath)
+		code := common.FileSaveFail
+		if err == errCheckSumFail {
+			code = common.FileCheckSumFail
+		}
+		logger.Error("sync-add fail", zap.String("url", url), zap.Error(err))
+		go s.TransErrorLogToTracker(code, "文件同步保存失败"+fullPath+" "+err.Error())
 		c.JSON(http.StatusOK, model.RespResult{
-			Status: common.Fail,
+			Status:  code,
+			Message: err.Error(),
 		})
 		return
 	}
@@ -325,36 +426,78 @@ func (s *Storage) SyncFileAdd(sync model.SyncFileInfo, c *gin.Context) {
 		ReName: info.Name(),
 		Url:    s.GenFileStaticUrl(sync.FilePath, sync.FileName),
 		Size:   info.Size(),
-		Path:   sync.FilePath,
-		Md5:    sync.FileHash,
+		Path:   sync.FilePath + "/" + sync.FileName,
+		Md5:    hash,
 		Group:  sync.Group,
 	}
-	bytes, _ := json.Marshal(fi)
-	_ = s.db.Put(sync.FileHash, bytes)
+	if _, err = s.saveFileInfo(fi); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status: common.Fail,
+		})
+		return
+	}
 	c.JSON(http.StatusOK, model.RespResult{
 		Status: common.Success,
 	})
 }
 
-//SyncFileDelete 文件删除同步函数
+//SyncFileDelete 文件删除同步函数 只删除file id的引用，没有其他引用时才删除文件
 func (s *Storage) SyncFileDelete(sync model.SyncFileInfo, c *gin.Context) {
-	gf := config()
-	//拼接路径
-	fullPath := strings.Join([]string{gf.Storage.StorageDir, sync.FilePath, sync.FileName}, "/")
-	if _, err := os.Stat(fullPath); err != nil {
-		c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+	remain, err := s.deleteFile(sync.FileHash, sync.FilePath+"/"+sync.FileName, sync.FileId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  pathErrorStatus(err),
+			Message: err.Error(),
+		})
 		return
 	}
-	//删除文件
-	err := os.Remove(fullPath)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   remain,
+	})
+}
+
+var errCheckSumFail = errors.New("file checksum mismatch")
+
+//downloadSyncFile 下载源storage的文件 边写临时文件边计算md5，与hash一致时才移动到dst 返回文件md5
+func (s *Storage) downloadSyncFile(url, dst, hash string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := util.DoNodeRequest(req, nil, 0)
 	if err != nil {
-		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
-		return
+		return "", err
 	}
-	if sync.FileHash != "" {
-		_ = s.db.Delete(sync.FileHash)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	dir := tmpDir() + "/sync"
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, "sync-*")
+	if err != nil {
+		return "", err
 	}
-	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if hash != "" && sum != hash {
+		return "", errCheckSumFail
+	}
+	return sum, moveFile(tmp, dst)
 }
 
 //TransErrorLogToTracker 同步错误日志到tracker
@@ -389,6 +532,18 @@ func (s *Storage) startTimerTask() error {
 	if err != nil {
 		return err
 	}
+	//10min 清理过期上传
+	_, err = cr.AddFunc("0 */10 * * * *", s.CleanExpiredUploads)
+	if err != nil {
+		return err
+	}
+	//副本一致性检查
+	if spec := antiEntropySpec(); spec != "" {
+		_, err = cr.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(s.AntiEntropy)))
+		if err != nil {
+			return err
+		}
+	}
 	cr.Start()
 	return nil
 }
@@ -406,22 +561,46 @@ func (s *Storage) Start() {
 		logger.Info("文件保存路径创建成功", zap.String("storage_dir", p))
 	}
 
+	//补全文件索引
+	s.rebuildFileIndex()
+	s.loadBootstrapInfo()
+	s.loadAccess()
+
 	r := gin.Default()
 
 	//file system
-	r.StaticFS(conf.Config().Storage.Group, http.Dir(config().Storage.StorageDir))
+	r.Group(conf.Config().Storage.Group, s.RedirectToken, s.StaticETag).StaticFS("/", storageFS{})
 
 	r.GET("/hello", hello)
+	r.GET("/health", s.Health)
 
 	//download file
-	r.GET("/download", s.Download)
+	r.GET("/download", s.RedirectToken, s.Download)
+	r.HEAD("/download", s.RedirectToken, s.Download)
+	//file id
+	r.GET("/file/:id", s.FileMeta)
+	r.GET("/file/:id/content", s.RedirectToken, s.FileContent)
+	r.GET("/refs/:md5", s.FileRefs)
+	//file catalog for bootstrap
+	r.GET("/catalog", NodeAuth, s.Catalog)
+	r.GET("/catalog/summary", NodeAuth, s.CatalogSummary)
 
 	//sync file
-	r.POST("/sync", s.Sync)
+	r.POST("/sync", NodeAuth, s.Sync)
 	r.Group("/v1")
 	{
 		//upload file
 		r.POST("/upload", s.QuickUpload)
+		//chunk upload
+		r.POST("/chunk/init", s.ChunkInit)
+		r.PUT("/chunk/upload", s.ChunkUpload)
+		r.POST("/chunk/complete", s.ChunkComplete)
+		r.POST("/chunk/abort", s.ChunkAbort)
+		//resumable upload
+		r.POST("/resumable", s.ResumableCreate)
+		r.HEAD("/resumable/:id", s.ResumableHead)
+		r.PATCH("/resumable/:id", s.ResumablePatch)
+		r.DELETE("/resumable/:id", s.ResumableAbort)
 	}
 
 	//开启定时任务
@@ -429,8 +608,8 @@ func (s *Storage) Start() {
 		logger.Panic("Storage定时任务启动失败", zap.String("addr", config().Host))
 	}
 
-	err := r.Run(":" + config().Port)
+	err := listenAndServe(r)
 	if err != nil {
-		logger.Panic("Storage服务启动失败", zap.String("addr", config().Host))
+		logger.Panic("Storage服务启动失败", zap.String("addr", config().Host), zap.Error(err))
 	}
 }
@@ -0,0 +1,267 @@
+package svc
+
+import (
+	"crypto/md5"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"hash"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//副本一致性检查
+//按md5前两位将文件目录分为256个桶，每个桶对文件md5及其引用计算摘要，所有桶的摘要再计算根摘要。
+//storage定时与group内其他storage比较摘要，只拉取不一致的桶，
+//对方有而本地没有的引用：本地没有删除记录时从对方同步；本地有而对方没有的引用：对方有删除记录时在本地删除。
+//每个storage只修复自身，对方的缺失由对方的检查修复
+
+const catalogBuckets = 256
+
+//catalogSummary 计算文件目录摘要
+func (s *Storage) catalogSummary() model.CatalogSummary {
+	hs := make([]hash.Hash, catalogBuckets)
+	_ = s.db.Range("", func(key, value []byte) bool {
+		if len(key) < 2 {
+			return true
+		}
+		b, err := strconv.ParseUint(string(key[:2]), 16, 8)
+		if err != nil {
+			return true
+		}
+		var fi model.FileInfo
+		if err = json.Unmarshal(value, &fi); err != nil || fi.Md5 == "" || !s.isFileExist(fi.Path) {
+			return true
+		}
+		if hs[b] == nil {
+			hs[b] = md5.New()
+		}
+		hs[b].Write([]byte(fi.Md5))
+		for _, ref := range s.fileRefs(fi.Md5) {
+			hs[b].Write([]byte("@" + ref.FileId))
+		}
+		hs[b].Write([]byte("\n"))
+		return true
+	})
+	summary := model.CatalogSummary{Buckets: make([]string, catalogBuckets)}
+	root := md5.New()
+	for i, h := range hs {
+		if h != nil {
+			summary.Buckets[i] = hex.EncodeToString(h.Sum(nil))
+		}
+		root.Write([]byte(summary.Buckets[i] + "\n"))
+	}
+	summary.Root = hex.EncodeToString(root.Sum(nil))
+	return summary
+}
+
+//CatalogSummary api 文件目录摘要
+func (s *Storage) CatalogSummary(c *gin.Context) {
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   s.catalogSummary(),
+	})
+}
+
+//antiEntropyInfo 最近一次一致性检查结果
+func (s *Storage) antiEntropyInfo() *model.AntiEntropyInfo {
+	s.bootLock.Lock()
+	defer s.bootLock.Unlock()
+	return s.antiEntropy
+}
+
+//AntiEntropy 与group内其他可用storage比较文件目录并修复本地差异
+func (s *Storage) AntiEntropy() {
+	if info := s.bootstrapInfo(); info != nil && info.State == common.BootstrapRunning {
+		return
+	}
+	s.cleanExpiredTombstones()
+	summary := s.catalogSummary()
+	info := &model.AntiEntropyInfo{Root: summary.Root, RunTime: time.Now().Unix()}
+	peers, err := s.groupPeers()
+	if err != nil {
+		info.Failed++
+		info.LastError = err.Error()
+	}
+	info.Peers = len(peers)
+	for _, peer := range peers {
+		ps, err := s.fetchCatalogSummary(peer)
+		if err != nil {
+			info.Failed++
+			info.LastError = err.Error()
+			continue
+		}
+		if ps.Root == summary.Root || len(ps.Buckets) != catalogBuckets {
+			continue
+		}
+		for i := 0; i < catalogBuckets; i++ {
+			if ps.Buckets[i] == summary.Buckets[i] {
+				continue
+			}
+			info.Divergent++
+			if err = s.repairBucket(peer, fmt.Sprintf("%02x", i), info); err != nil {
+				info.Failed++
+				info.LastError = err.Error()
+			}
+		}
+	}
+	if info.Added+info.Removed > 0 {
+		info.Root = s.catalogSummary().Root
+	}
+	if info.Divergent > 0 || info.Failed > 0 {
+		logger.Info("anti-entropy", zap.Any("info", info))
+	}
+	s.bootLock.Lock()
+	s.antiEntropy = info
+	s.bootLock.Unlock()
+}
+
+//repairBucket 拉取peer一个桶的文件目录并修复本地差异
+func (s *Storage) repairBucket(peer, prefix string, info *model.AntiEntropyInfo) error {
+	entries := make([]model.CatalogEntry, 0)
+	var peerDeleted map[string]bool
+	after := ""
+	for {
+		page, err := s.fetchCatalog(peer, prefix, after)
+		if err != nil {
+			return err
+		}
+		if peerDeleted == nil {
+			peerDeleted = tombstoneSet(page.Tombstones)
+		}
+		if len(page.Files) == 0 {
+			break
+		}
+		entries = append(entries, page.Files...)
+		after = page.Files[len(page.Files)-1].Md5
+	}
+	deleted := tombstoneSet(s.tombstones(prefix))
+
+	//对方有而本地没有的引用
+	peerRefs := make(map[string]bool)
+	for _, entry := range entries {
+		present := make([]model.FileRef, 0)
+		missing := make([]model.FileRef, 0)
+		for _, ref := range entry.Refs {
+			key := entry.Md5 + "@" + ref.FileId
+			peerRefs[key] = true
+			if deleted[key] {
+				continue
+			}
+			if exist, _ := s.indexDB.IsExistKey(refKey(entry.Md5, ref.FileId)); exist {
+				present = append(present, ref)
+			} else {
+				missing = append(missing, ref)
+			}
+		}
+		blob, err := s.getFileInfo(entry.Md5)
+		lost := err != nil || !s.isFileExist(blob.Path)
+		if len(missing) == 0 && (!lost || len(present) == 0) {
+			continue
+		}
+		//文件丢失时重新下载，保存文件信息时记录的引用取未删除的引用
+		first := append(missing, present...)[0]
+		entry.FileId, entry.Name = first.FileId, first.Name
+		entry.Refs = missing
+		if err = s.restoreCatalogEntry(peer, entry); err != nil {
+			info.Failed++
+			info.LastError = err.Error()
+			continue
+		}
+		info.Added += int64(len(missing))
+	}
+
+	//本地有而对方已删除的引用
+	_ = s.db.Range(prefix, func(key, value []byte) bool {
+		md5 := string(key)
+		for _, ref := range s.fileRefs(md5) {
+			k := md5 + "@" + ref.FileId
+			if peerRefs[k] || !peerDeleted[k] {
+				continue
+			}
+			if _, err := s.deleteFile(md5, "", ref.FileId); err == nil {
+				info.Removed++
+			}
+		}
+		return true
+	})
+	return nil
+}
+
+func tombstoneSet(ts []model.FileTombstone) map[string]bool {
+	set := make(map[string]bool, len(ts))
+	for _, t := range ts {
+		set[t.Md5+"@"+t.FileId] = true
+	}
+	return set
+}
+
+//groupPeers 从tracker获取group内其他可用storage
+func (s *Storage) groupPeers() ([]string, error) {
+	c := config()
+	self := net.JoinHostPort(c.Host, c.Port)
+	for _, tracker := range s.trackers {
+		resp, err := util.HttpGet(tracker+"/g/status?group="+c.Storage.Group, nil, time.Second*5)
+		if err != nil {
+			continue
+		}
+		var res struct {
+			Status int `json:"status"`
+			Data   struct {
+				Storages map[string]*StorageServer `json:"storages"`
+			} `json:"data"`
+		}
+		if err = json.Unmarshal(resp, &res); err != nil || res.Status != common.Success {
+			continue
+		}
+		peers := make([]string, 0)
+		for addr, server := range res.Data.Storages {
+			if addr != self && server.Status == common.StorageActive {
+				peers = append(peers, server.HttpSchema+"://"+addr)
+			}
+		}
+		return peers, nil
+	}
+	return nil, errors.New("no available tracker")
+}
+
+//fetchCatalogSummary 获取peer的文件目录摘要
+func (s *Storage) fetchCatalogSummary(peer string) (*model.CatalogSummary, error) {
+	resp, err := util.HttpGet(peer+"/catalog/summary", nil, time.Second*30)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Status  int                  `json:"status"`
+		Message string               `json:"message"`
+		Data    model.CatalogSummary `json:"data"`
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != common.Success {
+		return nil, errors.New("catalog summary fail: " + res.Message)
+	}
+	return &res.Data, nil
+}
+
+//antiEntropySpec 一致性检查的cron表达式 关闭时返回空
+func antiEntropySpec() string {
+	interval := config().Storage.AntiEntropyInterval
+	if interval < 0 {
+		return ""
+	}
+	if interval == 0 {
+		interval = common.DefaultAntiEntropyInterval
+	}
+	return "@every " + (time.Duration(interval) * time.Minute).String()
+}
@@ -0,0 +1,98 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//RedirectToken 校验tracker签发的下载签名
+//携带签名的请求必须校验通过，group为private或开启require_redirect_token时未携带签名的请求被拒绝，携带节点凭证的同步下载按节点间认证校验
+//未配置redirect_secret时private group只接受节点间请求
+func (s *Storage) RedirectToken(c *gin.Context) {
+	secret := config().RedirectSecret
+	token := c.Query("token")
+	if !s.private() && (token == "" || secret == "") {
+		c.Next()
+		return
+	}
+	//节点间同步下载文件
+	if token == "" && nodeRequest(c.Request) {
+		NodeAuth(c)
+		return
+	}
+	//没有签名密钥时private group无法校验签名 拒绝访问
+	if secret == "" {
+		logger.Warn("redirect_secret not configured for private group", zap.String("ip", c.ClientIP()))
+		c.AbortWithStatusJSON(http.StatusForbidden, model.RespResult{
+			Status:  common.DownloadTokenInvalid,
+			Message: "redirect_secret not configured",
+		})
+		return
+	}
+	file := c.Param("filepath")
+	if id := c.Param("id"); id != "" {
+		if fi, err := s.getFileInfoById(id); err == nil {
+			file = fi.Path
+		}
+	} else if file == "" {
+		file = c.Query("file")
+	}
+	file = config().Storage.Group + "/" + strings.TrimPrefix(file, "/")
+	if !util.VerifyDownload(secret, c.Request.URL.Query(), file, remoteIP(c.Request)) {
+		logger.Warn("invalid download token", zap.String("file", file), zap.String("ip", c.ClientIP()))
+		c.AbortWithStatusJSON(http.StatusForbidden, model.RespResult{
+			Status:  common.DownloadTokenInvalid,
+			Message: "invalid download token",
+		})
+		return
+	}
+	c.Next()
+}
+
+//accessKey 保存tracker最近一次回复的group访问模式
+const accessKey = "access@state"
+
+//private group是否只提供携带下载签名的文件
+//启动时使用上次保存的访问模式，从未收到tracker回复时按public处理，开启require_redirect_token时始终为private
+func (s *Storage) private() bool {
+	if config().Storage.RequireRedirectToken {
+		return true
+	}
+	access, _ := s.access.Load().(string)
+	return access == common.AccessPrivate
+}
+
+//setAccess 更新并保存tracker回复的group访问模式
+func (s *Storage) setAccess(access string) {
+	if access == "" {
+		return
+	}
+	if old, _ := s.access.Load().(string); old != access {
+		s.access.Store(access)
+		_ = s.indexDB.Put(accessKey, []byte(access))
+		logger.Info("group access changed", zap.String("group", config().Storage.Group), zap.String("access", access))
+	}
+}
+
+//loadAccess 加载上次保存的group访问模式
+func (s *Storage) loadAccess() {
+	if data, err := s.indexDB.Get(accessKey); err == nil && len(data) > 0 {
+		s.access.Store(string(data))
+	}
+}
+
+//remoteIP 连接的源地址 签名绑定的ip不使用可伪造的X-Forwarded-For
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,56 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/util"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedirectToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config()
+	secret, require := cfg.RedirectSecret, cfg.Storage.RequireRedirectToken
+	defer func() {
+		cfg.RedirectSecret, cfg.Storage.RequireRedirectToken = secret, require
+	}()
+
+	valid := "?" + util.SignDownload("secret", cfg.Storage.Group+"/a.txt", "", time.Minute).Encode()
+	cases := []struct {
+		name    string
+		access  string //空表示还没有收到tracker回复
+		secret  string
+		require bool
+		query   string
+		code    int
+	}{
+		{"first request before heartbeat", "", "", false, "", http.StatusOK},
+		{"first request before heartbeat with secret", "", "secret", false, "", http.StatusOK},
+		{"public", common.AccessPublic, "secret", false, "", http.StatusOK},
+		{"public invalid token", common.AccessPublic, "secret", false, "?token=x&expire=1", http.StatusForbidden},
+		{"private without secret", common.AccessPrivate, "", false, "", http.StatusForbidden},
+		{"private without token", common.AccessPrivate, "secret", false, "", http.StatusForbidden},
+		{"private valid token", common.AccessPrivate, "secret", false, valid, http.StatusOK},
+		{"require token before heartbeat", "", "secret", true, "", http.StatusForbidden},
+		{"require token valid token", common.AccessPublic, "secret", true, valid, http.StatusOK},
+	}
+	for _, tc := range cases {
+		s := &Storage{}
+		if tc.access != "" {
+			s.access.Store(tc.access)
+		}
+		cfg.RedirectSecret, cfg.Storage.RequireRedirectToken = tc.secret, tc.require
+		r := gin.New()
+		r.GET("/static/*filepath", s.RedirectToken, func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/a.txt"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//新加入或重建的storage从group内其他storage全量同步文件
+//tracker在storage回报status时判断是否需要全量同步并指定源storage，
+//storage按md5顺序分页拉取源storage的文件目录，已存在的文件只补全引用，同步完成前tracker不将其标记为可用
+
+const (
+	bootstrapKey    = "bootstrap@state"
+	catalogPageSize = 500
+)
+
+//Catalog api 按md5顺序分页列出文件目录 after为上一页最后一个md5
+//指定prefix时只列出md5前缀为prefix的文件，第一页同时返回删除记录
+func (s *Storage) Catalog(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > catalogPageSize {
+		limit = catalogPageSize
+	}
+	after := c.Query("after")
+	prefix := c.Query("prefix")
+	start := after
+	if start < prefix {
+		start = prefix
+	}
+	files := make([]model.CatalogEntry, 0)
+	_ = s.db.RangeFrom(start, func(key, value []byte) bool {
+		if !strings.HasPrefix(string(key), prefix) {
+			return false
+		}
+		if string(key) == after {
+			return true
+		}
+		var fi model.FileInfo
+		if err := json.Unmarshal(value, &fi); err != nil || fi.Md5 == "" || !s.isFileExist(fi.Path) {
+			return true
+		}
+		files = append(files, model.CatalogEntry{FileInfo: fi, Refs: s.fileRefs(fi.Md5)})
+		return len(files) < limit
+	})
+	page := model.CatalogPage{
+		Total: atomic.LoadInt64(&s.files),
+		Files: files,
+	}
+	if prefix != "" && after == "" {
+		page.Tombstones = s.tombstones(prefix)
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   page,
+	})
+}
+
+//loadBootstrapInfo 加载全量同步进度 重启前未完成的同步标记为失败，由tracker重新指定源storage
+func (s *Storage) loadBootstrapInfo() {
+	data, err := s.indexDB.Get(bootstrapKey)
+	if err != nil {
+		return
+	}
+	var info model.BootstrapInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return
+	}
+	if info.State == common.BootstrapRunning {
+		info.State = common.BootstrapFailed
+		info.LastError = "interrupted"
+	}
+	s.bootLock.Lock()
+	s.bootstrap = &info
+	s.bootLock.Unlock()
+}
+
+//bootstrapInfo 全量同步进度的副本 未同步过时返回nil
+func (s *Storage) bootstrapInfo() *model.BootstrapInfo {
+	s.bootLock.Lock()
+	defer s.bootLock.Unlock()
+	if s.bootstrap == nil {
+		return nil
+	}
+	info := *s.bootstrap
+	return &info
+}
+
+//updateBootstrap 更新并保存全量同步进度
+func (s *Storage) updateBootstrap(fn func(info *model.BootstrapInfo)) {
+	s.bootLock.Lock()
+	defer s.bootLock.Unlock()
+	fn(s.bootstrap)
+	s.bootstrap.UpdateTime = time.Now().Unix()
+	data, _ := json.Marshal(s.bootstrap)
+	_ = s.indexDB.Put(bootstrapKey, data)
+}
+
+//startBootstrap 开始从peer全量同步 正在同步时忽略
+func (s *Storage) startBootstrap(peer string) {
+	s.bootLock.Lock()
+	if s.bootstrap != nil && s.bootstrap.State == common.BootstrapRunning {
+		s.bootLock.Unlock()
+		return
+	}
+	s.bootstrap = &model.BootstrapInfo{
+		State:     common.BootstrapRunning,
+		Peer:      peer,
+		StartTime: time.Now().Unix(),
+	}
+	s.bootLock.Unlock()
+	s.updateBootstrap(func(info *model.BootstrapInfo) {})
+	logger.Info("bootstrap start", zap.String("peer", peer))
+	go s.runBootstrap(peer)
+}
+
+//runBootstrap 分页拉取peer的文件目录并同步
+func (s *Storage) runBootstrap(peer string) {
+	after := ""
+	for {
+		page, err := s.fetchCatalog(peer, "", after)
+		if err != nil {
+			logger.Error("bootstrap fail", zap.String("peer", peer), zap.Error(err))
+			s.updateBootstrap(func(info *model.BootstrapInfo) {
+				info.State = common.BootstrapFailed
+				info.LastError = err.Error()
+			})
+			return
+		}
+		if len(page.Files) == 0 {
+			break
+		}
+		for _, entry := range page.Files {
+			err := s.restoreCatalogEntry(peer, entry)
+			if err != nil {
+				logger.Warn("bootstrap file fail", zap.String("md5", entry.Md5), zap.Error(err))
+			}
+			s.updateBootstrap(func(info *model.BootstrapInfo) {
+				info.Total = page.Total
+				info.Done++
+				if err != nil {
+					info.Failed++
+					info.LastError = err.Error()
+				}
+			})
+		}
+		after = page.Files[len(page.Files)-1].Md5
+	}
+	s.updateBootstrap(func(info *model.BootstrapInfo) {
+		info.State = common.BootstrapDone
+		if info.Failed > 0 {
+			info.State = common.BootstrapFailed
+		}
+	})
+	info := s.bootstrapInfo()
+	logger.Info("bootstrap finish", zap.Any("info", info))
+	if info.State == common.BootstrapFailed {
+		go s.TransErrorLogToTracker(common.FileSaveFail, fmt.Sprintf("全量同步失败%d个文件 %s", info.Failed, info.LastError))
+	}
+}
+
+//fetchCatalog 获取peer的一页文件目录
+func (s *Storage) fetchCatalog(peer, prefix, after string) (*model.CatalogPage, error) {
+	q := url.Values{"prefix": {prefix}, "after": {after}, "limit": {strconv.Itoa(catalogPageSize)}}
+	resp, err := util.HttpGet(peer+"/catalog?"+q.Encode(), nil, time.Second*30)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Status  int               `json:"status"`
+		Message string            `json:"message"`
+		Data    model.CatalogPage `json:"data"`
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != common.Success {
+		return nil, errors.New("catalog fail: " + res.Message)
+	}
+	return &res.Data, nil
+}
+
+//restoreCatalogEntry 同步一个文件 文件已存在时只补全引用
+func (s *Storage) restoreCatalogEntry(peer string, entry model.CatalogEntry) error {
+	if blob, err := s.getFileInfo(entry.Md5); err == nil && s.isFileExist(blob.Path) {
+		return s.mergeFileRefs(entry.Md5, entry.Refs)
+	}
+	group := config().Storage.Group
+	fullPath, err := storagePath(entry.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := s.downloadSyncFile(s.peerFileUrl(peer, group, entry.Path), fullPath, entry.Md5); err != nil {
+		return err
+	}
+	fi := entry.FileInfo
+	fi.Group = group
+	fi.Url = s.GenFileStaticUrl(path.Dir(entry.Path), path.Base(entry.Path))
+	if _, err := s.saveFileInfo(fi); err != nil {
+		return err
+	}
+	return s.mergeFileRefs(entry.Md5, entry.Refs)
+}
+
+//peerFileUrl 其他storage的文件地址 配置了签名密钥时附带签名
+func (s *Storage) peerFileUrl(peer, group, filePath string) string {
+	target := fmt.Sprintf("%s/%s/%s", peer, group, (&url.URL{Path: filePath}).EscapedPath())
+	if secret := config().RedirectSecret; secret != "" {
+		target += "?" + util.SignDownload(secret, group+"/"+filePath, "", time.Minute).Encode()
+	}
+	return target
+}
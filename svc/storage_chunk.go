@@ -0,0 +1,424 @@
+package svc
+
+import (
+	"crypto/md5"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+//tmpDir 临时文件根目录
+func tmpDir() string {
+	if d := config().Storage.TmpDir; d != "" {
+		return d
+	}
+	return defaultTmpDir
+}
+
+//chunkDir 分片暂存目录
+func chunkDir(uploadId string) string {
+	return tmpDir() + "/chunk/" + uploadId
+}
+
+//chunkPartPath 分片文件路径
+func chunkPartPath(uploadId string, part int) string {
+	return chunkDir(uploadId) + "/" + strconv.Itoa(part)
+}
+
+//ChunkInit 初始化分片上传
+func (s *Storage) ChunkInit(c *gin.Context) {
+	var params struct {
+		FileName string `json:"file_name" binding:"required"`
+		Size     int64  `json:"size" binding:"required"`
+		PartSize int64  `json:"part_size" binding:"required"`
+		Md5      string `json:"md5"`
+	}
+	if err := c.ShouldBindJSON(&params); err != nil || params.Size <= 0 || params.PartSize <= 0 {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: "参数绑定失败",
+		})
+		return
+	}
+
+	//秒传
+	if params.Md5 != "" {
+		if fi, err := s.addFileRef(params.Md5, c.GetHeader(common.HeaderFileUUID), params.FileName); err == nil {
+			setUploadResHeader(c, fi)
+			c.JSON(http.StatusOK, model.RespResult{
+				Status:  common.Success,
+				Message: "文件已存在，秒传成功",
+				Data:    fi,
+			})
+			return
+		}
+	}
+
+	//文件大小限制
+	if config().Storage.FileSizeLimit > 0 && params.Size > config().Storage.FileSizeLimit {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSizeExceeded,
+			Message: "文件大小超过限制",
+		})
+		return
+	}
+	totalParts := (params.Size + params.PartSize - 1) / params.PartSize
+	if totalParts > common.MaxChunkParts {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkPartInvalid,
+			Message: "分片数量超过限制",
+		})
+		return
+	}
+
+	uploadId := c.GetHeader(common.HeaderFileUUID)
+	if uploadId == "" {
+		uploadId = util.GenFileUUID()
+	}
+	if err := util.CheckPathElem(uploadId); err != nil {
+		respPathError(c, err)
+		return
+	}
+	filePath, err := uploadFilePath(c)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	if err := os.MkdirAll(chunkDir(uploadId), os.ModePerm); err != nil {
+		logger.Error("分片暂存路径创建失败", zap.String("upload_id", uploadId))
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.DirCreateFail,
+			Message: "分片暂存路径创建失败",
+		})
+		return
+	}
+
+	now := time.Now().Unix()
+	info := model.ChunkUploadInfo{
+		UploadId:   uploadId,
+		FileName:   params.FileName,
+		FilePath:   filePath,
+		Size:       params.Size,
+		PartSize:   params.PartSize,
+		TotalParts: int(totalParts),
+		Md5:        params.Md5,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	bytes, _ := json.Marshal(info)
+	if err := s.chunkDB.Put(uploadId, bytes); err != nil {
+		_ = os.RemoveAll(chunkDir(uploadId))
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.Writer.Header().Set(common.HeaderUploadId, uploadId)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "分片上传初始化成功",
+		Data:    info,
+	})
+}
+
+//ChunkUpload 上传单个分片 请求体即分片内容
+func (s *Storage) ChunkUpload(c *gin.Context) {
+	uploadId := c.Query("upload_id")
+	if !s.rlockUpload(uploadId) {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.UploadLocked,
+			Message: "分片上传正在合并或取消",
+		})
+		return
+	}
+	defer s.unlockUpload(uploadId)
+	info, err := s.getChunkUpload(uploadId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkUploadNotFound,
+			Message: "分片上传不存在",
+		})
+		return
+	}
+	part, err := strconv.Atoi(c.Query("part"))
+	if err != nil || part < 1 || part > info.TotalParts {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkPartInvalid,
+			Message: "分片序号错误",
+		})
+		return
+	}
+	//记录上传活动 过期清理按最近一次上传分片的时间计算
+	s.touchChunkUpload(info)
+	expect := info.PartSize
+	if part == info.TotalParts {
+		expect = info.Size - int64(part-1)*info.PartSize
+	}
+
+	//先写临时文件，校验通过后再重命名，避免留下残缺分片
+	dst := chunkPartPath(info.UploadId, part)
+	tmp := dst + "." + util.GenFileUUID()
+	f, err := os.Create(tmp)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(c.Request.Body, expect+1))
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if n != expect {
+		_ = os.Remove(tmp)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkPartInvalid,
+			Message: fmt.Sprintf("分片大小不匹配 expect:%d actual:%d", expect, n),
+		})
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if hash := c.GetHeader(common.HeaderFileHash); hash != "" && hash != sum {
+		_ = os.Remove(tmp)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileCheckSumFail,
+			Message: "分片校验失败",
+		})
+		return
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "分片保存成功",
+		Data: model.ChunkPartInfo{
+			UploadId: info.UploadId,
+			Part:     part,
+			Size:     n,
+			Md5:      sum,
+		},
+	})
+}
+
+//ChunkComplete 合并分片，写入文件信息
+func (s *Storage) ChunkComplete(c *gin.Context) {
+	uploadId := c.Query("upload_id")
+	if !s.lockUpload(uploadId) {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.UploadLocked,
+			Message: "分片上传正在进行中",
+		})
+		return
+	}
+	defer s.unlockUpload(uploadId)
+	info, err := s.getChunkUpload(uploadId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkUploadNotFound,
+			Message: "分片上传不存在",
+		})
+		return
+	}
+	//检查分片是否完整
+	missing := make([]int, 0)
+	for i := 1; i <= info.TotalParts; i++ {
+		if _, err := os.Stat(chunkPartPath(info.UploadId, i)); err != nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkIncomplete,
+			Message: "分片未上传完整",
+			Data:    missing,
+		})
+		return
+	}
+
+	fileName := util.GenFileName(info.UploadId, info.FileName)
+	baseDir, err := storagePath(info.FilePath)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	fullPath, err := storageFilePath(info.FilePath, fileName)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	if err := os.MkdirAll(baseDir, os.ModePerm); err != nil {
+		go s.TransErrorLogToTracker(common.DirCreateFail, "文件保存路径创建失败"+baseDir)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.DirCreateFail,
+			Message: "文件保存路径创建失败",
+		})
+		return
+	}
+	md5hash, err := s.mergeChunks(info, fullPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if info.Md5 != "" && info.Md5 != md5hash {
+		_ = os.Remove(fullPath)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileCheckSumFail,
+			Message: "file is already damaged",
+		})
+		return
+	}
+
+	fi := model.FileInfo{
+		FileId: info.UploadId,
+		Name:   info.FileName,
+		ReName: fileName,
+		Url:    s.GenFileStaticUrl(info.FilePath, fileName),
+		Path:   fmt.Sprintf("%s/%s", info.FilePath, fileName),
+		Md5:    md5hash,
+		Size:   info.Size,
+		Group:  config().Storage.Group,
+	}
+	if fi, err = s.saveFileInfo(fi); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	s.removeChunkUpload(info.UploadId)
+
+	setUploadResHeader(c, fi)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "文件保存成功",
+		Data:    fi,
+	})
+}
+
+//ChunkAbort 取消分片上传，清理暂存分片
+func (s *Storage) ChunkAbort(c *gin.Context) {
+	uploadId := c.Query("upload_id")
+	if !s.lockUpload(uploadId) {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.UploadLocked,
+			Message: "分片上传正在进行中",
+		})
+		return
+	}
+	defer s.unlockUpload(uploadId)
+	if _, err := s.getChunkUpload(uploadId); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkUploadNotFound,
+			Message: "分片上传不存在",
+		})
+		return
+	}
+	s.removeChunkUpload(uploadId)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "分片上传已取消",
+	})
+}
+
+//touchChunkUpload 更新分片上传会话的活动时间
+func (s *Storage) touchChunkUpload(info *model.ChunkUploadInfo) {
+	info.UpdateTime = time.Now().Unix()
+	bytes, _ := json.Marshal(info)
+	if err := s.chunkDB.Put(info.UploadId, bytes); err != nil {
+		logger.Warn("分片上传会话更新失败", zap.String("upload_id", info.UploadId), zap.Error(err))
+	}
+}
+
+//getChunkUpload 获取分片上传会话
+func (s *Storage) getChunkUpload(uploadId string) (*model.ChunkUploadInfo, error) {
+	data, err := s.chunkDB.Get(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	var info model.ChunkUploadInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+//removeChunkUpload 删除分片上传会话以及暂存分片
+func (s *Storage) removeChunkUpload(uploadId string) {
+	_ = s.chunkDB.Delete(uploadId)
+	if err := os.RemoveAll(chunkDir(uploadId)); err != nil {
+		logger.Warn("分片暂存清理失败", zap.String("upload_id", uploadId), zap.Error(err))
+	}
+}
+
+//mergeChunks 按序合并分片到dst 返回合并后文件的md5
+func (s *Storage) mergeChunks(info *model.ChunkUploadInfo, dst string) (md5hash string, err error) {
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	h := md5.New()
+	w := io.MultiWriter(out, h)
+	var total int64
+	for i := 1; i <= info.TotalParts; i++ {
+		var n int64
+		n, err = appendFile(w, chunkPartPath(info.UploadId, i))
+		if err != nil {
+			break
+		}
+		total += n
+	}
+	_ = out.Close()
+	if err == nil && total != info.Size {
+		err = errors.New("merged file size mismatch")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//appendFile 将src文件内容写入w
+func appendFile(w io.Writer, src string) (int64, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
@@ -0,0 +1,74 @@
+package svc
+
+import (
+	"crypto/md5"
+	"eggdfs/common/model"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//setTmpDir 使用临时目录作为tmp_dir 返回恢复函数
+func setTmpDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "eggdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config()
+	old := cfg.Storage.TmpDir
+	cfg.Storage.TmpDir = dir
+	return func() {
+		cfg.Storage.TmpDir = old
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestMergeChunks(t *testing.T) {
+	defer setTmpDir(t)()
+	cases := []struct {
+		name  string
+		parts []string //为空的分片不写入
+		size  int64
+		err   bool
+	}{
+		{"in order", []string{"hello ", "chunked ", "world"}, 19, false},
+		{"single part", []string{"hello"}, 5, false},
+		{"missing part", []string{"hello ", "", "world"}, 19, true},
+		{"size mismatch", []string{"hello ", "world"}, 12, true},
+	}
+	for i, tc := range cases {
+		info := &model.ChunkUploadInfo{UploadId: fmt.Sprintf("merge%d", i), TotalParts: len(tc.parts), Size: tc.size}
+		if err := os.MkdirAll(chunkDir(info.UploadId), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for n, part := range tc.parts {
+			if part != "" {
+				_ = ioutil.WriteFile(chunkPartPath(info.UploadId, n+1), []byte(part), 0644)
+			}
+		}
+		dst := filepath.Join(config().Storage.TmpDir, info.UploadId+".txt")
+		sum, err := new(Storage).mergeChunks(info, dst)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: err %v", tc.name, err)
+			continue
+		}
+		if _, serr := os.Stat(dst + ".tmp"); serr == nil {
+			t.Errorf("%s: tmp file left", tc.name)
+		}
+		if tc.err {
+			if _, serr := os.Stat(dst); serr == nil {
+				t.Errorf("%s: dst created on error", tc.name)
+			}
+			continue
+		}
+		data, _ := ioutil.ReadFile(dst)
+		want := md5.Sum([]byte(strings.Join(tc.parts, "")))
+		if string(data) != strings.Join(tc.parts, "") || sum != hex.EncodeToString(want[:]) {
+			t.Errorf("%s: merged %q md5 %s", tc.name, data, sum)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//storage文件元数据
+//相同md5的文件只保存一份，每次上传(包括秒传)记录一个引用，最后一个引用删除时才删除文件
+//db:      md5 -> FileInfo
+//indexDB: path@{path} -> md5
+//         id@{file_id} -> md5
+//         ref@{md5}@{file_id} -> 上传时的文件名
+//         del@{md5}@{file_id} -> 删除时间 副本一致性检查时区分缺少的文件与未删除的文件
+
+const (
+	indexDBFileName = "storage-index"
+	indexPathPrefix = "path@"
+	indexIdPrefix   = "id@"
+	indexRefPrefix  = "ref@"
+	indexDelPrefix  = "del@"
+)
+
+func refKey(md5, fileId string) string {
+	return indexRefPrefix + md5 + "@" + fileId
+}
+
+//saveFileInfo 保存新上传的文件信息
+//已存在相同md5的文件时删除新保存的文件，只记录引用 返回该次上传的文件信息
+func (s *Storage) saveFileInfo(fi model.FileInfo) (model.FileInfo, error) {
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	if blob, err := s.getFileInfo(fi.Md5); err == nil && blob.Path != fi.Path && s.isFileExist(blob.Path) {
+		if full, err := storagePath(fi.Path); err == nil {
+			_ = os.Remove(full)
+		}
+		if err = s.putFileRef(blob.Md5, fi.FileId, fi.Name); err != nil {
+			return fi, err
+		}
+		return logicalFileInfo(*blob, fi.FileId, fi.Name), nil
+	}
+
+	bytes, err := json.Marshal(fi)
+	if err != nil {
+		return fi, err
+	}
+	exist, _ := s.db.IsExistKey(fi.Md5)
+	if err = s.db.Put(fi.Md5, bytes); err != nil {
+		return fi, err
+	}
+	if !exist {
+		atomic.AddInt64(&s.files, 1)
+	}
+	if err = s.indexDB.Put(indexPathPrefix+fi.Path, []byte(fi.Md5)); err != nil {
+		return fi, err
+	}
+	return fi, s.putFileRef(fi.Md5, fi.FileId, fi.Name)
+}
+
+//addFileRef 秒传 为已存在的文件增加引用
+func (s *Storage) addFileRef(md5, fileId, name string) (model.FileInfo, error) {
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	blob, err := s.getFileInfo(md5)
+	if err != nil {
+		return model.FileInfo{}, err
+	}
+	if !s.isFileExist(blob.Path) {
+		return model.FileInfo{}, errors.New("file is lost")
+	}
+	if fileId == "" {
+		fileId = util.GenFileUUID()
+	}
+	if err = s.putFileRef(md5, fileId, name); err != nil {
+		return model.FileInfo{}, err
+	}
+	return logicalFileInfo(*blob, fileId, name), nil
+}
+
+//deleteFile 删除file id的引用，没有其他引用时删除文件 返回剩余引用数
+//未指定file id时只允许删除没有其他引用的文件
+func (s *Storage) deleteFile(md5, filePath, fileId string) (int, error) {
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	var blob *model.FileInfo
+	if md5 != "" {
+		blob, _ = s.getFileInfo(md5)
+	}
+	if blob == nil && filePath != "" {
+		blob, _ = s.getFileInfoByPath(filePath)
+	}
+
+	if blob != nil {
+		refs := s.fileRefs(blob.Md5)
+		remain := 0
+		for _, ref := range refs {
+			if ref.FileId != fileId {
+				remain++
+			}
+		}
+		if fileId == "" && len(refs) > 1 {
+			return len(refs), fmt.Errorf("file is referenced by %d uploads, file_id required", len(refs))
+		}
+		if fileId != "" {
+			_ = s.indexDB.Delete(refKey(blob.Md5, fileId), indexIdPrefix+fileId)
+			s.putTombstone(blob.Md5, fileId)
+			if remain > 0 {
+				return remain, nil
+			}
+		}
+		filePath = blob.Path
+	}
+	if filePath == "" {
+		return 0, nil
+	}
+
+	full, err := storagePath(filePath)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.Remove(full); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	keys := []string{indexPathPrefix + filePath}
+	if blob != nil {
+		for _, ref := range s.fileRefs(blob.Md5) {
+			keys = append(keys, refKey(blob.Md5, ref.FileId), indexIdPrefix+ref.FileId)
+			s.putTombstone(blob.Md5, ref.FileId)
+		}
+		if s.db.Delete(blob.Md5) == nil {
+			atomic.AddInt64(&s.files, -1)
+		}
+	}
+	_ = s.indexDB.Delete(keys...)
+	return 0, nil
+}
+
+//putFileRef 记录引用以及file id索引
+func (s *Storage) putFileRef(md5, fileId, name string) error {
+	if err := s.indexDB.Put(refKey(md5, fileId), []byte(name)); err != nil {
+		return err
+	}
+	_ = s.indexDB.Delete(indexDelPrefix + md5 + "@" + fileId)
+	if fileId == "" {
+		return nil
+	}
+	return s.indexDB.Put(indexIdPrefix+fileId, []byte(md5))
+}
+
+//putTombstone 记录引用删除
+func (s *Storage) putTombstone(md5, fileId string) {
+	_ = s.indexDB.Put(indexDelPrefix+md5+"@"+fileId, []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+}
+
+//tombstones 获取md5前缀为prefix的删除记录
+func (s *Storage) tombstones(prefix string) []model.FileTombstone {
+	ts := make([]model.FileTombstone, 0)
+	_ = s.indexDB.Range(indexDelPrefix+prefix, func(key, value []byte) bool {
+		k := strings.TrimPrefix(string(key), indexDelPrefix)
+		i := strings.Index(k, "@")
+		if i < 0 {
+			return true
+		}
+		t, _ := strconv.ParseInt(string(value), 10, 64)
+		ts = append(ts, model.FileTombstone{Md5: k[:i], FileId: k[i+1:], DeleteTime: t})
+		return true
+	})
+	return ts
+}
+
+//cleanExpiredTombstones 清理过期的删除记录
+func (s *Storage) cleanExpiredTombstones() {
+	deadline := time.Now().Add(-common.DefaultTombstoneExpire * time.Hour).Unix()
+	expired := make([]string, 0)
+	for _, t := range s.tombstones("") {
+		if t.DeleteTime < deadline {
+			expired = append(expired, indexDelPrefix+t.Md5+"@"+t.FileId)
+		}
+	}
+	_ = s.indexDB.Delete(expired...)
+}
+
+//fileRefs 获取文件的所有引用
+func (s *Storage) fileRefs(md5 string) []model.FileRef {
+	refs := make([]model.FileRef, 0)
+	prefix := indexRefPrefix + md5 + "@"
+	_ = s.indexDB.Range(prefix, func(key, value []byte) bool {
+		refs = append(refs, model.FileRef{
+			FileId: strings.TrimPrefix(string(key), prefix),
+			Name:   string(value),
+		})
+		return true
+	})
+	return refs
+}
+
+//rebuildFileIndex 为索引建立之前保存的文件补全索引与引用 并统计文件数
+func (s *Storage) rebuildFileIndex() {
+	iter := s.db.Ldb.NewIterator(nil, nil)
+	defer iter.Release()
+	var files int64
+	for iter.Next() {
+		var fi model.FileInfo
+		if err := json.Unmarshal(iter.Value(), &fi); err != nil || fi.Md5 == "" {
+			continue
+		}
+		files++
+		if exist, _ := s.indexDB.IsExistKey(indexPathPrefix + fi.Path); !exist {
+			_ = s.indexDB.Put(indexPathPrefix+fi.Path, []byte(fi.Md5))
+		}
+		if len(s.fileRefs(fi.Md5)) == 0 {
+			_ = s.putFileRef(fi.Md5, fi.FileId, fi.Name)
+		}
+	}
+	atomic.StoreInt64(&s.files, files)
+}
+
+//mergeFileRefs 补全缺少的引用
+func (s *Storage) mergeFileRefs(md5 string, refs []model.FileRef) error {
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	for _, ref := range refs {
+		if exist, _ := s.indexDB.IsExistKey(refKey(md5, ref.FileId)); exist {
+			continue
+		}
+		if err := s.putFileRef(md5, ref.FileId, ref.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getFileInfo md5获取文件信息
+func (s *Storage) getFileInfo(md5 string) (*model.FileInfo, error) {
+	data, err := s.db.Get(md5)
+	if err != nil {
+		return nil, err
+	}
+	var fi model.FileInfo
+	if err = json.Unmarshal(data, &fi); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
+
+//getFileInfoByPath 文件路径获取文件信息
+func (s *Storage) getFileInfoByPath(filePath string) (*model.FileInfo, error) {
+	md5, err := s.indexDB.Get(indexPathPrefix + strings.TrimPrefix(filePath, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return s.getFileInfo(string(md5))
+}
+
+//getFileInfoById file id获取该次上传的文件信息
+func (s *Storage) getFileInfoById(fileId string) (*model.FileInfo, error) {
+	md5, err := s.indexDB.Get(indexIdPrefix + fileId)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := s.getFileInfo(string(md5))
+	if err != nil {
+		return nil, err
+	}
+	name, err := s.indexDB.Get(refKey(blob.Md5, fileId))
+	if err != nil {
+		return nil, err
+	}
+	fi := logicalFileInfo(*blob, fileId, string(name))
+	return &fi, nil
+}
+
+//logicalFileInfo 以引用的file id与文件名展示文件信息
+func logicalFileInfo(blob model.FileInfo, fileId, name string) model.FileInfo {
+	blob.FileId = fileId
+	if name != "" {
+		blob.Name = name
+	}
+	return blob
+}
+
+func (s *Storage) isFileExist(filePath string) bool {
+	full, err := storagePath(filePath)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(full)
+	return err == nil
+}
+
+//setUploadResHeader 上传成功的响应头 tracker据此同步文件
+func setUploadResHeader(c *gin.Context, fi model.FileInfo) {
+	c.Writer.Header().Set(common.HeaderFileUploadRes, strconv.Itoa(common.Success))
+	c.Writer.Header().Set(common.HeaderFileHash, fi.Md5)
+	c.Writer.Header().Set(common.HeaderFilePath, fi.Path)
+}
+
+//fileETag 文件ETag 取存储的md5，元数据不存在时返回空
+func (s *Storage) fileETag(filePath string) string {
+	fi, err := s.getFileInfoByPath(filePath)
+	if err != nil || fi.Md5 == "" {
+		return ""
+	}
+	return `"` + fi.Md5 + `"`
+}
+
+//StaticETag 静态文件中间件 设置ETag以支持If-None-Match与If-Range
+func (s *Storage) StaticETag(c *gin.Context) {
+	if etag := s.fileETag(c.Param("filepath")); etag != "" {
+		c.Writer.Header().Set("ETag", etag)
+	}
+	c.Next()
+}
+
+//FileMeta file id获取文件信息
+func (s *Storage) FileMeta(c *gin.Context) {
+	fi, err := s.getFileInfoById(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileNotFound,
+			Message: "no such file",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   fi,
+	})
+}
+
+//FileContent file id下载文件
+func (s *Storage) FileContent(c *gin.Context) {
+	fi, err := s.getFileInfoById(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileNotFound,
+			Message: "no such file",
+		})
+		return
+	}
+	fullPath, err := storagePath(fi.Path)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	if _, err = os.Stat(fullPath); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileNotFound,
+			Message: "no such file",
+		})
+		return
+	}
+	c.Writer.Header().Set("ETag", `"`+fi.Md5+`"`)
+	c.Writer.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fi.Name))
+	c.Writer.Header().Add("Content-Type", util.GetFileContentType(path.Ext(fi.Name)))
+	c.File(fullPath)
+}
+
+//FileRefs 文件引用数
+func (s *Storage) FileRefs(c *gin.Context) {
+	md5 := c.Param("md5")
+	if exist, _ := s.db.IsExistKey(md5); !exist {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileNotFound,
+			Message: "no such file",
+		})
+		return
+	}
+	refs := s.fileRefs(md5)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data: model.FileRefInfo{
+			Md5:   md5,
+			Count: len(refs),
+			Refs:  refs,
+		},
+	})
+}
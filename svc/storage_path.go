@@ -0,0 +1,69 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//storage文件路径
+//storage_dir下的文件操作都通过storagePath解析相对路径，来自请求参数、请求头、同步任务以及其他storage的路径
+//包含绝对路径、..、NUL字节或符号链接逃逸storage_dir时返回PathInvalid
+
+//storagePath storage_dir下文件的完整路径 rel为相对storage_dir的路径
+func storagePath(rel string) (string, error) {
+	return util.ResolvePath(config().Storage.StorageDir, rel)
+}
+
+//storageFilePath dir目录下name文件的完整路径 name只能是单个路径元素
+func storageFilePath(dir, name string) (string, error) {
+	if err := util.CheckPathElem(name); err != nil {
+		return "", err
+	}
+	return storagePath(dir + "/" + name)
+}
+
+//uploadFilePath 上传文件的保存目录 请求头Egg-Dfs-FileDir为日期目录下的自定义目录
+func uploadFilePath(c *gin.Context) (string, error) {
+	dir, err := util.CleanRelPath(c.GetHeader(common.HeaderUploadFileDir))
+	if err != nil {
+		return "", err
+	}
+	return util.GenFilePath(dir), nil
+}
+
+//pathErrorStatus 路径解析失败的返回码
+func pathErrorStatus(err error) int {
+	if errors.Is(err, util.ErrUnsafePath) {
+		return common.PathInvalid
+	}
+	return common.Fail
+}
+
+//respPathError 返回路径解析失败的响应
+func respPathError(c *gin.Context, err error) {
+	logger.Warn("invalid file path", zap.String("url", c.Request.URL.Path), zap.String("ip", c.ClientIP()), zap.Error(err))
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  pathErrorStatus(err),
+		Message: err.Error(),
+	})
+}
+
+//storageFS storage_dir的静态文件 路径解析失败时拒绝访问
+type storageFS struct{}
+
+func (storageFS) Open(name string) (http.File, error) {
+	full, err := storagePath(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		logger.Warn("invalid static path", zap.String("path", name), zap.Error(err))
+		return nil, os.ErrPermission
+	}
+	return os.Open(full)
+}
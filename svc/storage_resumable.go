@@ -0,0 +1,449 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+//断点续传上传 storage端
+//POST创建上传，HEAD查询当前偏移量，PATCH从偏移量处继续写入
+
+//resumableDataPath 断点续传暂存文件路径
+func resumableDataPath(uploadId string) string {
+	return tmpDir() + "/resumable/" + uploadId
+}
+
+//ResumableCreate 创建断点续传上传
+func (s *Storage) ResumableCreate(c *gin.Context) {
+	var params struct {
+		FileName string `json:"file_name" binding:"required"`
+		Size     int64  `json:"size" binding:"required"`
+		Md5      string `json:"md5"`
+	}
+	if err := c.ShouldBindJSON(&params); err != nil || params.Size <= 0 {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: "参数绑定失败",
+		})
+		return
+	}
+
+	//秒传
+	if params.Md5 != "" {
+		if fi, err := s.addFileRef(params.Md5, c.GetHeader(common.HeaderFileUUID), params.FileName); err == nil {
+			setUploadResHeader(c, fi)
+			c.JSON(http.StatusOK, model.RespResult{
+				Status:  common.Success,
+				Message: "文件已存在，秒传成功",
+				Data:    fi,
+			})
+			return
+		}
+	}
+
+	if config().Storage.FileSizeLimit > 0 && params.Size > config().Storage.FileSizeLimit {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSizeExceeded,
+			Message: "文件大小超过限制",
+		})
+		return
+	}
+
+	uploadId := c.GetHeader(common.HeaderFileUUID)
+	if uploadId == "" {
+		uploadId = util.GenFileUUID()
+	}
+	if err := util.CheckPathElem(uploadId); err != nil {
+		respPathError(c, err)
+		return
+	}
+	filePath, err := uploadFilePath(c)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	dataPath := resumableDataPath(uploadId)
+	if err := os.MkdirAll(tmpDir()+"/resumable", os.ModePerm); err != nil {
+		logger.Error("续传暂存路径创建失败", zap.String("upload_id", uploadId))
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.DirCreateFail,
+			Message: "续传暂存路径创建失败",
+		})
+		return
+	}
+	f, err := os.Create(dataPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	_ = f.Close()
+
+	now := time.Now().Unix()
+	info := model.ResumableUploadInfo{
+		UploadId:   uploadId,
+		FileName:   params.FileName,
+		FilePath:   filePath,
+		Size:       params.Size,
+		Md5:        params.Md5,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	if err = s.putResumableUpload(&info); err != nil {
+		_ = os.Remove(dataPath)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.Writer.Header().Set(common.HeaderUploadId, uploadId)
+	c.Writer.Header().Set("Location", "/resumable/"+uploadId)
+	c.Writer.Header().Set(common.HeaderUploadOffset, "0")
+	c.Writer.Header().Set(common.HeaderUploadLength, strconv.FormatInt(info.Size, 10))
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "续传上传创建成功",
+		Data:    info,
+	})
+}
+
+//ResumableHead 查询已上传的偏移量
+func (s *Storage) ResumableHead(c *gin.Context) {
+	info, err := s.getResumableUpload(c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Writer.Header().Set("Cache-Control", "no-store")
+	c.Writer.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(info.Offset, 10))
+	c.Writer.Header().Set(common.HeaderUploadLength, strconv.FormatInt(info.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+//ResumablePatch 从偏移量处追加数据 上传完成后写入文件信息
+func (s *Storage) ResumablePatch(c *gin.Context) {
+	uploadId := c.Param("id")
+	if !s.lockUpload(uploadId) {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.UploadLocked,
+			Message: "上传正在进行中",
+		})
+		return
+	}
+	defer s.unlockUpload(uploadId)
+
+	info, err := s.getResumableUpload(uploadId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkUploadNotFound,
+			Message: "续传上传不存在",
+		})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader(common.HeaderUploadOffset), 10, 64)
+	if err != nil || offset != info.Offset {
+		c.Writer.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(info.Offset, 10))
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.UploadOffsetMismatch,
+			Message: "偏移量不匹配",
+			Data:    info,
+		})
+		return
+	}
+
+	n, err := s.appendResumableData(info, c.Request.Body)
+	info.Offset += n
+	info.UpdateTime = time.Now().Unix()
+	//即使连接中断也记录已写入的偏移量，客户端可据此继续上传
+	if perr := s.putResumableUpload(info); perr != nil {
+		logger.Error("续传偏移量保存失败", zap.String("upload_id", uploadId), zap.Error(perr))
+	}
+	c.Writer.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(info.Offset, 10))
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+			Data:    info,
+		})
+		return
+	}
+	if info.Offset < info.Size {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Success,
+			Message: "数据保存成功",
+			Data:    info,
+		})
+		return
+	}
+	s.finishResumableUpload(info, c)
+}
+
+//ResumableAbort 取消断点续传上传
+func (s *Storage) ResumableAbort(c *gin.Context) {
+	uploadId := c.Param("id")
+	if _, err := s.getResumableUpload(uploadId); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkUploadNotFound,
+			Message: "续传上传不存在",
+		})
+		return
+	}
+	s.removeResumableUpload(uploadId)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "续传上传已取消",
+	})
+}
+
+//appendResumableData 从记录的偏移量处写入数据，最多写到文件总大小
+func (s *Storage) appendResumableData(info *model.ResumableUploadInfo, src io.Reader) (int64, error) {
+	f, err := os.OpenFile(resumableDataPath(info.UploadId), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	//丢弃上次异常中断时偏移量之后未记录的数据
+	if err = f.Truncate(info.Offset); err != nil {
+		return 0, err
+	}
+	if _, err = f.Seek(info.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(src, info.Size-info.Offset))
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+//finishResumableUpload 校验并将上传完成的文件移动到存储目录
+func (s *Storage) finishResumableUpload(info *model.ResumableUploadInfo, c *gin.Context) {
+	dataPath := resumableDataPath(info.UploadId)
+	local, err := os.Open(dataPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	md5hash, _ := util.GenMD5(local)
+	_ = local.Close()
+	if info.Md5 != "" && info.Md5 != md5hash {
+		s.removeResumableUpload(info.UploadId)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileCheckSumFail,
+			Message: "file is already damaged",
+		})
+		return
+	}
+
+	fileName := util.GenFileName(info.UploadId, info.FileName)
+	baseDir, err := storagePath(info.FilePath)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	fullPath, err := storageFilePath(info.FilePath, fileName)
+	if err != nil {
+		respPathError(c, err)
+		return
+	}
+	if err = os.MkdirAll(baseDir, os.ModePerm); err != nil {
+		go s.TransErrorLogToTracker(common.DirCreateFail, "文件保存路径创建失败"+baseDir)
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.DirCreateFail,
+			Message: "文件保存路径创建失败",
+		})
+		return
+	}
+	if err = moveFile(dataPath, fullPath); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	fi := model.FileInfo{
+		FileId: info.UploadId,
+		Name:   info.FileName,
+		ReName: fileName,
+		Url:    s.GenFileStaticUrl(info.FilePath, fileName),
+		Path:   fmt.Sprintf("%s/%s", info.FilePath, fileName),
+		Md5:    md5hash,
+		Size:   info.Size,
+		Group:  config().Storage.Group,
+	}
+	if fi, err = s.saveFileInfo(fi); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSaveFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	s.removeResumableUpload(info.UploadId)
+
+	setUploadResHeader(c, fi)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "文件保存成功",
+		Data:    fi,
+	})
+}
+
+//lockUpload 同一上传同时只允许一个写入请求 分片上传的合并、取消与清理同样独占
+func (s *Storage) lockUpload(uploadId string) bool {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	if s.uploading[uploadId] != 0 {
+		return false
+	}
+	s.uploading[uploadId] = -1
+	return true
+}
+
+//rlockUpload 同一分片上传的分片可以同时上传 与独占的操作互斥
+func (s *Storage) rlockUpload(uploadId string) bool {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	if s.uploading[uploadId] < 0 {
+		return false
+	}
+	s.uploading[uploadId]++
+	return true
+}
+
+func (s *Storage) unlockUpload(uploadId string) {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	if s.uploading[uploadId] > 1 {
+		s.uploading[uploadId]--
+		return
+	}
+	delete(s.uploading, uploadId)
+}
+
+func (s *Storage) getResumableUpload(uploadId string) (*model.ResumableUploadInfo, error) {
+	data, err := s.resumableDB.Get(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	var info model.ResumableUploadInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *Storage) putResumableUpload(info *model.ResumableUploadInfo) error {
+	bytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.resumableDB.Put(info.UploadId, bytes)
+}
+
+func (s *Storage) removeResumableUpload(uploadId string) {
+	_ = s.resumableDB.Delete(uploadId)
+	if err := os.Remove(resumableDataPath(uploadId)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("续传暂存清理失败", zap.String("upload_id", uploadId), zap.Error(err))
+	}
+}
+
+//CleanExpiredUploads 清理超过upload_expire没有上传活动的分片上传与续传上传
+func (s *Storage) CleanExpiredUploads() {
+	deadline := time.Now().Add(-uploadExpire()).Unix()
+
+	iter := s.resumableDB.Ldb.NewIterator(nil, nil)
+	expired := make([]string, 0)
+	for iter.Next() {
+		var info model.ResumableUploadInfo
+		if err := json.Unmarshal(iter.Value(), &info); err != nil {
+			continue
+		}
+		if info.UpdateTime < deadline {
+			expired = append(expired, info.UploadId)
+		}
+	}
+	iter.Release()
+	for _, id := range expired {
+		if !s.lockUpload(id) {
+			continue
+		}
+		if info, err := s.getResumableUpload(id); err == nil && info.UpdateTime < deadline {
+			logger.Info("清理过期续传上传", zap.String("upload_id", id))
+			s.removeResumableUpload(id)
+		}
+		s.unlockUpload(id)
+	}
+
+	iter = s.chunkDB.Ldb.NewIterator(nil, nil)
+	expired = expired[:0]
+	for iter.Next() {
+		var info model.ChunkUploadInfo
+		if err := json.Unmarshal(iter.Value(), &info); err != nil {
+			continue
+		}
+		if info.UpdateTime < deadline {
+			expired = append(expired, info.UploadId)
+		}
+	}
+	iter.Release()
+	for _, id := range expired {
+		if !s.lockUpload(id) {
+			continue
+		}
+		//加锁前可能已完成或有新的分片上传
+		if info, err := s.getChunkUpload(id); err == nil && info.UpdateTime < deadline {
+			logger.Info("清理过期分片上传", zap.String("upload_id", id))
+			s.removeChunkUpload(id)
+		}
+		s.unlockUpload(id)
+	}
+}
+
+//moveFile 移动文件 跨文件系统时退化为复制
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,52 @@
+package svc
+
+import (
+	"eggdfs/common/model"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendResumableData(t *testing.T) {
+	defer setTmpDir(t)()
+	cases := []struct {
+		name   string
+		exist  string //已写入的数据 包括异常中断时偏移量之后未记录的数据
+		offset int64
+		size   int64
+		data   string
+		want   string
+	}{
+		{"first write", "", 0, 11, "hello world", "hello world"},
+		{"continue", "hello ", 6, 11, "world", "hello world"},
+		{"drop unrecorded data", "hello wo??", 6, 11, "world", "hello world"},
+		{"limit to size", "hello ", 6, 11, "world and more", "hello world"},
+		{"partial", "", 0, 11, "hello", "hello"},
+	}
+	for i, tc := range cases {
+		info := &model.ResumableUploadInfo{UploadId: fmt.Sprintf("append%d", i), Offset: tc.offset, Size: tc.size}
+		p := resumableDataPath(info.UploadId)
+		_ = os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(tc.exist), 0644); err != nil {
+			t.Fatal(err)
+		}
+		n, err := new(Storage).appendResumableData(info, strings.NewReader(tc.data))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		data, _ := ioutil.ReadFile(p)
+		if string(data) != tc.want || tc.offset+n != int64(len(tc.want)) {
+			t.Errorf("%s: got %q written %d", tc.name, data, n)
+		}
+	}
+
+	//数据文件不存在
+	info := &model.ResumableUploadInfo{UploadId: "missing", Size: 5}
+	if _, err := new(Storage).appendResumableData(info, strings.NewReader("hello")); err == nil {
+		t.Error("missing data file accepted")
+	}
+}
@@ -0,0 +1,213 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//StorageSelector 选择group内处理请求的storage storages为可用的storage 按addr排序且不为空
+//key为请求的客户端ip
+type StorageSelector interface {
+	Select(key string, storages []*StorageServer) (*StorageServer, error)
+}
+
+//newStorageSelector 根据策略名称创建StorageSelector 为空时使用一致性hash
+func (t *Tracker) newStorageSelector(strategy string) (StorageSelector, error) {
+	switch strategy {
+	case "", common.StorageSelectHash:
+		vnodes := config().Tracker.HashVnodes
+		if vnodes <= 0 {
+			vnodes = common.DefaultHashVnodes
+		}
+		return NewConsistentHashSelector(t.hash, vnodes), nil
+	case common.StorageSelectRoundRobin:
+		return &RoundRobinStorageSelector{}, nil
+	case common.StorageSelectLeastInFlight:
+		return &LeastInFlightSelector{InFlight: t.InFlight}, nil
+	case common.StorageSelectWeighted:
+		return &WeightedStorageSelector{rand: newLockedRand()}, nil
+	}
+	return nil, errors.New("unknown storage selector: " + strategy)
+}
+
+//ConsistentHashSelector 一致性hash环 每个storage对应vnodes个虚拟节点
+//storage加入或离开时只有该storage相邻区间的客户端会重新映射
+type ConsistentHashSelector struct {
+	hash   Hash
+	vnodes int
+	mu     sync.Mutex
+	rings  map[string]*hashRing //group -> ring
+}
+
+type hashRing struct {
+	members string   //构建时的storage列表
+	points  []uint32 //虚拟节点hash 升序
+	addrs   []string //虚拟节点对应的storage
+}
+
+func NewConsistentHashSelector(fn Hash, vnodes int) *ConsistentHashSelector {
+	return &ConsistentHashSelector{hash: fn, vnodes: vnodes, rings: make(map[string]*hashRing)}
+}
+
+func (s *ConsistentHashSelector) Select(key string, storages []*StorageServer) (*StorageServer, error) {
+	ring := s.ring(storages)
+	h := s.hash([]byte(key))
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i] >= h
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+	for _, server := range storages {
+		if server.Addr == ring.addrs[i] {
+			return server, nil
+		}
+	}
+	return storages[0], nil
+}
+
+//ring 获取group的hash环 storage列表变化时重建
+func (s *ConsistentHashSelector) ring(storages []*StorageServer) *hashRing {
+	addrs := make([]string, 0, len(storages))
+	for _, server := range storages {
+		addrs = append(addrs, server.Addr)
+	}
+	members := strings.Join(addrs, ",")
+	group := storages[0].Group
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.rings[group]; ok && r.members == members {
+		return r
+	}
+	type vnode struct {
+		point uint32
+		addr  string
+	}
+	vnodes := make([]vnode, 0, len(addrs)*s.vnodes)
+	for _, addr := range addrs {
+		for i := 0; i < s.vnodes; i++ {
+			vnodes = append(vnodes, vnode{point: s.hash([]byte(addr + "#" + strconv.Itoa(i))), addr: addr})
+		}
+	}
+	sort.Slice(vnodes, func(i, j int) bool {
+		if vnodes[i].point == vnodes[j].point {
+			return vnodes[i].addr < vnodes[j].addr
+		}
+		return vnodes[i].point < vnodes[j].point
+	})
+	r := &hashRing{
+		members: members,
+		points:  make([]uint32, len(vnodes)),
+		addrs:   make([]string, len(vnodes)),
+	}
+	for i, v := range vnodes {
+		r.points[i], r.addrs[i] = v.point, v.addr
+	}
+	s.rings[group] = r
+	return r
+}
+
+//RoundRobinStorageSelector 轮询选择storage
+type RoundRobinStorageSelector struct {
+	next uint64
+}
+
+func (s *RoundRobinStorageSelector) Select(key string, storages []*StorageServer) (*StorageServer, error) {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return storages[n%uint64(len(storages))], nil
+}
+
+//LeastInFlightSelector 选择tracker代理中正在处理的请求数最少的storage 请求数相同时轮询
+type LeastInFlightSelector struct {
+	InFlight func(addr string) int64
+	next     uint64
+}
+
+func (s *LeastInFlightSelector) Select(key string, storages []*StorageServer) (*StorageServer, error) {
+	start := int(atomic.AddUint64(&s.next, 1) % uint64(len(storages)))
+	var best *StorageServer
+	var min int64
+	for i := range storages {
+		server := storages[(start+i)%len(storages)]
+		n := s.InFlight(server.Addr)
+		if best == nil || n < min {
+			best, min = server, n
+		}
+	}
+	return best, nil
+}
+
+//WeightedStorageSelector 按剩余空间加权随机选择storage 设置了权重的storage按剩余空间*权重计算
+type WeightedStorageSelector struct {
+	rand *lockedRand
+}
+
+func (s *WeightedStorageSelector) Select(key string, storages []*StorageServer) (*StorageServer, error) {
+	weights := make([]uint64, len(storages))
+	var total uint64
+	for i, server := range storages {
+		weights[i] = server.Free >> 20 //按MB计算 避免溢出
+		if server.Attr.Weight > 0 {
+			weights[i] *= uint64(server.Attr.Weight)
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return storages[s.rand.Intn(len(storages))], nil
+	}
+	n := s.rand.Uint64n(total)
+	for i, w := range weights {
+		if n < w {
+			return storages[i], nil
+		}
+		n -= w
+	}
+	return storages[len(storages)-1], nil
+}
+
+//InFlight storage正在代理中的请求数
+func (t *Tracker) InFlight(addr string) int64 {
+	if v, ok := t.inflight.Load(addr); ok {
+		return atomic.LoadInt64(v.(*int64))
+	}
+	return 0
+}
+
+//trackInFlight 记录代理中的请求 返回请求结束时调用的函数
+func (t *Tracker) trackInFlight(addr string) func() {
+	v, _ := t.inflight.LoadOrStore(addr, new(int64))
+	n := v.(*int64)
+	atomic.AddInt64(n, 1)
+	return func() {
+		atomic.AddInt64(n, -1)
+	}
+}
+
+//SelectStorageForUpload 按upload_selector选择上传的storage
+func (t *Tracker) SelectStorageForUpload(ip string, g *Group) (*StorageServer, error) {
+	return selectStorage(t.uploadSelector, ip, g, (*StorageServer).Writable)
+}
+
+//SelectStorageForDownload 按download_selector选择读取文件的storage
+func (t *Tracker) SelectStorageForDownload(ip string, g *Group) (*StorageServer, error) {
+	return selectStorage(t.downloadSelector, ip, g, (*StorageServer).Servable)
+}
+
+func selectStorage(selector StorageSelector, ip string, g *Group, usable func(*StorageServer) bool) (*StorageServer, error) {
+	as := make([]*StorageServer, 0)
+	for _, s := range g.GetStorages() {
+		if usable(s) {
+			as = append(as, s)
+		}
+	}
+	if len(as) == 0 {
+		return nil, errors.New("no available storage for group")
+	}
+	return selector.Select(ip, as)
+}
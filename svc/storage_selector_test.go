@@ -0,0 +1,65 @@
+package svc
+
+import (
+	"fmt"
+	"hash/crc32"
+	"testing"
+)
+
+func hashStorages(addrs ...string) []*StorageServer {
+	storages := make([]*StorageServer, 0, len(addrs))
+	for _, addr := range addrs {
+		storages = append(storages, &StorageServer{Group: "g1", Addr: addr})
+	}
+	return storages
+}
+
+func TestConsistentHashRemap(t *testing.T) {
+	base := []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080"}
+	cases := []struct {
+		name   string
+		after  []string
+		member string //加入或离开的storage
+		added  bool
+	}{
+		{"add", append(append([]string{}, base...), "10.0.0.5:8080"), "10.0.0.5:8080", true},
+		{"remove first", base[1:], base[0], false},
+		{"remove middle", []string{base[0], base[1], base[3]}, base[2], false},
+	}
+	const clients = 2000
+	for _, tc := range cases {
+		//同一selector在storage列表变化时重建hash环 分别使用两个selector避免反复重建
+		s := NewConsistentHashSelector(crc32.ChecksumIEEE, 100)
+		s2 := NewConsistentHashSelector(crc32.ChecksumIEEE, 100)
+		before := hashStorages(base...)
+		after := hashStorages(tc.after...)
+		moved := 0
+		for i := 0; i < clients; i++ {
+			ip := fmt.Sprintf("192.168.%d.%d", i/256, i%256)
+			a, _ := s.Select(ip, before)
+			b, _ := s2.Select(ip, after)
+			if a.Addr == b.Addr {
+				continue
+			}
+			moved++
+			//只有新加入storage的区间或离开storage的客户端重新映射
+			if tc.added && b.Addr != tc.member || !tc.added && a.Addr != tc.member {
+				t.Errorf("%s: %s moved from %s to %s", tc.name, ip, a.Addr, b.Addr)
+			}
+		}
+		if moved == 0 || moved > clients/2 {
+			t.Errorf("%s: %d of %d clients moved", tc.name, moved, clients)
+		}
+	}
+}
+
+func TestConsistentHashStable(t *testing.T) {
+	s := NewConsistentHashSelector(crc32.ChecksumIEEE, 100)
+	storages := hashStorages("10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080")
+	first, _ := s.Select("192.168.0.1", storages)
+	for i := 0; i < 10; i++ {
+		if got, _ := s.Select("192.168.0.1", storages); got != first {
+			t.Fatalf("select %s, want %s", got.Addr, first.Addr)
+		}
+	}
+}
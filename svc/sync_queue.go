@@ -0,0 +1,188 @@
+package svc
+
+import (
+	"crypto/md5"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/util"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+//SyncQueue 持久化的文件同步队列
+//每个同步任务有唯一id，同一storage上同一文件的任务按入队顺序执行，失败后指数退避重试，
+//超过最大尝试次数进入死信状态，等待人工重试或清理
+//task@{id} -> SyncTask
+//file@{file key}@{id} -> "" 同一文件的任务索引
+type SyncQueue struct {
+	db    KVStore
+	locks sync.Map //file key -> *sync.Mutex
+}
+
+const (
+	syncQueueDBName   = "sync-queue"
+	syncTaskPrefix    = "task@"
+	syncFileIdxPrefix = "file@"
+)
+
+func NewSyncQueue(db KVStore) *SyncQueue {
+	return &SyncQueue{db: db}
+}
+
+//syncFileKey 同一目标storage上的同一文件
+func syncFileKey(info model.SyncFileInfo) string {
+	sum := md5.Sum([]byte(strings.Join([]string{info.Dst, info.Group, info.FilePath, info.FileName}, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+//Push 任务入队
+func (q *SyncQueue) Push(info model.SyncFileInfo) (*model.SyncTask, error) {
+	now := time.Now().Unix()
+	task := &model.SyncTask{
+		Id:         util.GenFileUUID(),
+		FileKey:    syncFileKey(info),
+		Info:       info,
+		State:      common.SyncTaskPending,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	if err := q.put(task); err != nil {
+		return nil, err
+	}
+	if err := q.db.Put(syncFileIdxPrefix+task.FileKey+"@"+task.Id, nil); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+//Get 获取任务
+func (q *SyncQueue) Get(id string) (*model.SyncTask, error) {
+	data, err := q.db.Get(syncTaskPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	var task model.SyncTask
+	if err = json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+//Remove 删除任务
+func (q *SyncQueue) Remove(task *model.SyncTask) error {
+	return q.db.Delete(syncTaskPrefix+task.Id, syncFileIdxPrefix+task.FileKey+"@"+task.Id)
+}
+
+//Fail 记录失败 按指数退避计算下次重试时间，超过最大尝试次数进入死信状态
+func (q *SyncQueue) Fail(task *model.SyncTask, err error) error {
+	task.Attempts++
+	task.LastError = err.Error()
+	task.UpdateTime = time.Now().Unix()
+	if task.Attempts >= syncMaxAttempts() {
+		task.State = common.SyncTaskDead
+	} else {
+		task.NextRetry = task.UpdateTime + syncBackoff(task.Attempts)
+	}
+	return q.put(task)
+}
+
+//Delay 推迟任务 不计入尝试次数 用于目标storage暂不可用的情况
+func (q *SyncQueue) Delay(task *model.SyncTask, reason string) error {
+	task.LastError = reason
+	task.UpdateTime = time.Now().Unix()
+	task.NextRetry = task.UpdateTime + syncBackoff(1)
+	return q.put(task)
+}
+
+//Retry 死信任务重新进入队列
+func (q *SyncQueue) Retry(task *model.SyncTask) error {
+	task.State = common.SyncTaskPending
+	task.Attempts = 0
+	task.NextRetry = 0
+	task.UpdateTime = time.Now().Unix()
+	return q.put(task)
+}
+
+//List 按入队顺序列出任务 state为空时列出所有任务
+func (q *SyncQueue) List(state string, limit int) []*model.SyncTask {
+	tasks := make([]*model.SyncTask, 0)
+	_ = q.db.Range(syncTaskPrefix, func(key, value []byte) bool {
+		var task model.SyncTask
+		if err := json.Unmarshal(value, &task); err != nil {
+			return true
+		}
+		if state == "" || task.State == state {
+			tasks = append(tasks, &task)
+		}
+		return limit <= 0 || len(tasks) < limit
+	})
+	return tasks
+}
+
+//FileTasks 按入队顺序获取同一文件的任务
+func (q *SyncQueue) FileTasks(fileKey string) []*model.SyncTask {
+	ids := make([]string, 0)
+	prefix := syncFileIdxPrefix + fileKey + "@"
+	_ = q.db.Range(prefix, func(key, value []byte) bool {
+		ids = append(ids, strings.TrimPrefix(string(key), prefix))
+		return true
+	})
+	tasks := make([]*model.SyncTask, 0, len(ids))
+	for _, id := range ids {
+		if task, err := q.Get(id); err == nil {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
+
+//LockFile 同一文件的任务串行执行
+func (q *SyncQueue) LockFile(fileKey string) func() {
+	l, _ := q.locks.LoadOrStore(fileKey, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (q *SyncQueue) put(task *model.SyncTask) error {
+	if task.Id == "" {
+		return errors.New("task id can not be nil")
+	}
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return q.db.Put(syncTaskPrefix+task.Id, data)
+}
+
+//syncMaxAttempts 同步任务最大尝试次数
+func syncMaxAttempts() int {
+	if n := config().Tracker.SyncMaxAttempts; n > 0 {
+		return n
+	}
+	return common.DefaultSyncMaxAttempts
+}
+
+//syncBackoff 第n次失败后的重试间隔 单位秒
+func syncBackoff(n int) int64 {
+	base := config().Tracker.SyncRetryBase
+	if base <= 0 {
+		base = common.DefaultSyncRetryBase
+	}
+	max := config().Tracker.SyncRetryMax
+	if max <= 0 {
+		max = common.DefaultSyncRetryMax
+	}
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
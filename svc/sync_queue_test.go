@@ -0,0 +1,197 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//memKV 测试用的内存KVStore Range按key顺序遍历
+type memKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemKV() *memKV {
+	return &memKV{data: make(map[string][]byte)}
+}
+
+func (m *memKV) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.data[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return v, nil
+}
+
+func (m *memKV) Put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = value
+	return nil
+}
+
+func (m *memKV) Delete(keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		delete(m.data, k)
+	}
+	return nil
+}
+
+func (m *memKV) Range(prefix string, fn func(key, value []byte) bool) error {
+	m.mu.Lock()
+	keys := make([]string, 0)
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := m.Get(k)
+		if err != nil {
+			continue
+		}
+		if !fn([]byte(k), v) {
+			break
+		}
+	}
+	return nil
+}
+
+//setSyncRetry 临时修改同步重试配置 返回恢复函数
+func setSyncRetry(attempts int, base, max int64) func() {
+	cfg := config()
+	old := cfg.Tracker
+	cfg.Tracker.SyncMaxAttempts, cfg.Tracker.SyncRetryBase, cfg.Tracker.SyncRetryMax = attempts, base, max
+	return func() {
+		cfg.Tracker.SyncMaxAttempts, cfg.Tracker.SyncRetryBase, cfg.Tracker.SyncRetryMax =
+			old.SyncMaxAttempts, old.SyncRetryBase, old.SyncRetryMax
+	}
+}
+
+func TestSyncBackoff(t *testing.T) {
+	defer setSyncRetry(3, 10, 60)()
+	cases := []struct {
+		n    int
+		want int64
+	}{
+		{1, 10},
+		{2, 20},
+		{3, 40},
+		{4, 60},
+		{10, 60},
+	}
+	for _, tc := range cases {
+		if got := syncBackoff(tc.n); got != tc.want {
+			t.Errorf("syncBackoff(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestSyncQueueFileOrder(t *testing.T) {
+	q := NewSyncQueue(newMemKV())
+	a := model.SyncFileInfo{Dst: "127.0.0.1:8082", Group: "g1", FilePath: "2021/1/1", FileName: "a.txt"}
+	b := a
+	b.FileName = "b.txt"
+	ids := make([]string, 0)
+	for _, info := range []model.SyncFileInfo{a, b, a, a} {
+		task, err := q.Push(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info == a {
+			ids = append(ids, task.Id)
+		}
+	}
+	tasks := q.FileTasks(syncFileKey(a))
+	if len(tasks) != len(ids) {
+		t.Fatalf("got %d tasks, want %d", len(tasks), len(ids))
+	}
+	for i, task := range tasks {
+		if task.Id != ids[i] {
+			t.Errorf("task %d = %s, want %s", i, task.Id, ids[i])
+		}
+	}
+	if err := q.Remove(tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if tasks = q.FileTasks(syncFileKey(a)); len(tasks) != 2 || tasks[0].Id != ids[1] {
+		t.Fatal("removed task still indexed")
+	}
+}
+
+func TestSyncQueueFail(t *testing.T) {
+	defer setSyncRetry(3, 10, 60)()
+	q := NewSyncQueue(newMemKV())
+	task, _ := q.Push(model.SyncFileInfo{Dst: "127.0.0.1:8082", Group: "g1", FileName: "a.txt"})
+	cases := []struct {
+		state string
+		wait  int64
+	}{
+		{common.SyncTaskPending, 10},
+		{common.SyncTaskPending, 20},
+		{common.SyncTaskDead, 0},
+	}
+	for i, tc := range cases {
+		if err := q.Fail(task, errors.New("fail")); err != nil {
+			t.Fatal(err)
+		}
+		task, _ = q.Get(task.Id)
+		if task.State != tc.state || task.Attempts != i+1 {
+			t.Errorf("attempt %d: state %s attempts %d", i+1, task.State, task.Attempts)
+		}
+		if tc.wait > 0 && task.NextRetry != task.UpdateTime+tc.wait {
+			t.Errorf("attempt %d: next retry after %d, want %d", i+1, task.NextRetry-task.UpdateTime, tc.wait)
+		}
+	}
+	//Delay 不计入尝试次数
+	_ = q.Retry(task)
+	_ = q.Delay(task, "offline")
+	if task.Attempts != 0 || task.State != common.SyncTaskPending || task.NextRetry == 0 {
+		t.Fatal("delay counted as attempt")
+	}
+}
+
+func TestRunSyncFileTasksBlocked(t *testing.T) {
+	info := model.SyncFileInfo{Dst: "127.0.0.1:8082", Group: "g1", FileName: "a.txt"}
+	cases := []struct {
+		name  string
+		first func(q *SyncQueue, task *model.SyncTask)
+	}{
+		{"dead", func(q *SyncQueue, task *model.SyncTask) {
+			task.State = common.SyncTaskDead
+			_ = q.put(task)
+		}},
+		{"not due", func(q *SyncQueue, task *model.SyncTask) {
+			task.NextRetry = time.Now().Unix() + 60
+			_ = q.put(task)
+		}},
+	}
+	for _, tc := range cases {
+		q := NewSyncQueue(newMemKV())
+		tr := &Tracker{syncQueue: q}
+		first, _ := q.Push(info)
+		second, _ := q.Push(info)
+		tc.first(q, first)
+		tr.runSyncFileTasks(first.FileKey)
+		//之后的任务没有执行
+		task, err := q.Get(second.Id)
+		if err != nil || task.Attempts != 0 || task.UpdateTime != second.UpdateTime || task.LastError != "" {
+			t.Errorf("%s: task after blocked task executed", tc.name)
+		}
+		if len(q.FileTasks(first.FileKey)) != 2 {
+			t.Errorf("%s: blocked tasks removed", tc.name)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"eggdfs/common/model"
 	"eggdfs/logger"
 	"eggdfs/util"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -14,7 +13,7 @@ import (
 	"hash/crc32"
 	"net"
 	"net/http"
-	"sort"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,24 +23,69 @@ import (
 type Hash func([]byte) uint32
 
 type Tracker struct {
-	groups     map[string]*Group
-	syncDB     *model.EggDB //sync err log
-	hash       Hash
-	mu         sync.RWMutex //map mutex
-	lock       sync.Mutex   //process mutex
-	statusLock sync.Mutex   //status compute mutex
+	groups           map[string]*Group
+	syncQueue        *SyncQueue              //sync task queue
+	uploadDB         *replicatedDB           //upload session route
+	decommissionDB   *replicatedDB           //decommission task
+	retiredDB        *replicatedDB           //decommissioned group@addr
+	redirectDB       *replicatedDB           //file location after rebalance
+	rebalanceDB      *replicatedDB           //rebalance plan & progress
+	apiKeyDB         *replicatedDB           //api key
+	accessDB         *replicatedDB           //group access mode
+	dbs              map[string]*model.EggDB //replicated db by name
+	cluster          Consensus               //shared state replication
+	groupDB          *model.EggDB            //group & storage registration
+	fileGroups       sync.Map                //file id -> group name cache
+	hash             Hash
+	groupSelector    GroupSelector
+	uploadSelector   StorageSelector
+	downloadSelector StorageSelector
+	inflight         sync.Map       //storage addr -> *int64 proxying requests
+	rebalance        rebalanceState //local rebalance runner
+	health           healthChecker  //active health probe
+	nonces           nonceCache     //api key request nonce
+	mu               sync.RWMutex   //map mutex
+	lock             sync.Mutex     //process mutex
+	statusLock       sync.Mutex     //status compute mutex
 }
 
-//NewTracker 构造函数可使用自定义的hash
-func NewTracker(fn Hash) *Tracker {
+//NewTracker 构造函数可使用自定义的hash以及上传group选择策略 gs为nil时使用配置的group_selector
+func NewTracker(fn Hash, gs GroupSelector) *Tracker {
 	t := &Tracker{
-		groups: make(map[string]*Group),
-		syncDB: model.NewEggDB("sync-err"),
-		hash:   fn,
-	}
+		groups:        make(map[string]*Group),
+		health:        healthChecker{states: make(map[string]*HealthState)},
+		dbs:           make(map[string]*model.EggDB),
+		hash:          fn,
+		groupSelector: gs,
+	}
+	if t.groupSelector == nil {
+		selector, err := NewGroupSelector(config().Tracker.GroupSelector)
+		if err != nil {
+			logger.Panic(err.Error())
+		}
+		t.groupSelector = selector
+	}
+	t.groupDB = model.NewEggDB(groupDBName)
+	t.loadGroups()
+	t.syncQueue = NewSyncQueue(t.newReplicatedDB(syncQueueDBName))
+	t.uploadDB = t.newReplicatedDB("upload")
+	t.decommissionDB = t.newReplicatedDB(decommissionDBName)
+	t.retiredDB = t.newReplicatedDB(retiredDBName)
+	t.redirectDB = t.newReplicatedDB(redirectDBName)
+	t.rebalanceDB = t.newReplicatedDB(rebalanceDBName)
+	t.apiKeyDB = t.newReplicatedDB(apiKeyDBName)
+	t.accessDB = t.newReplicatedDB(accessDBName)
+	t.cluster = newConsensus(t)
 	if t.hash == nil {
 		t.hash = crc32.ChecksumIEEE
 	}
+	var err error
+	if t.uploadSelector, err = t.newStorageSelector(config().Tracker.UploadSelector); err != nil {
+		logger.Panic(err.Error())
+	}
+	if t.downloadSelector, err = t.newStorageSelector(config().Tracker.DownloadSelector); err != nil {
+		logger.Panic(err.Error())
+	}
 	return t
 }
 
@@ -49,29 +93,80 @@ func NewTracker(fn Hash) *Tracker {
 func (t *Tracker) Start() {
 	r := gin.Default()
 
+	read, write := t.Auth(common.AuthRoleRead), t.Auth(common.AuthRoleWrite)
+
 	//report storage status
-	r.POST("/status", t.StorageStatusReport)
+	r.POST("/status", NodeAuth, t.StorageStatusReport)
 	r.Group("/v1")
 	{
 		//upload file
-		r.POST("/upload", t.QuickUpload)
+		r.POST("/upload", write, t.QuickUpload)
+		//chunk upload
+		r.POST("/chunk/init", write, t.ChunkInit)
+		r.PUT("/chunk/upload", write, t.ChunkUpload)
+		r.POST("/chunk/complete", write, t.ChunkComplete)
+		r.POST("/chunk/abort", write, t.ChunkAbort)
+		//resumable upload
+		r.POST("/resumable", write, t.ResumableCreate)
+		r.HEAD("/resumable/:id", write, t.ResumableHead)
+		r.PATCH("/resumable/:id", write, t.ResumablePatch)
+		r.DELETE("/resumable/:id", write, t.ResumableAbort)
 	}
 	//delete file
-	r.POST("/delete", t.Delete)
+	r.POST("/delete", write, t.Delete)
 	//get group status
-	r.GET("/g/status", t.GroupStatus)
+	r.GET("/g/status", t.NodeOrAuth(common.AuthRoleRead), t.GroupStatus)
+	//get group replica divergence
+	r.GET("/g/divergence", read, t.GroupDivergence)
 	//sync err-log from storage
-	r.POST("/err/log", t.SyncErrorMsg)
-	r.GET("/download", t.Download)
-
+	r.POST("/err/log", NodeAuth, t.SyncErrorMsg)
+	//Range、If-None-Match等请求头由反向代理透传，storage返回206/304
+	r.GET("/download", read, t.Download)
+	r.HEAD("/download", read, t.Download)
+	//file id
+	r.GET("/file/:id", read, t.FileInfo)
+	r.GET("/file/:id/content", read, t.FileContent)
+	r.GET("/refs/:md5", read, t.FileRefs)
+	//signed download url
+	r.GET("/sign", read, t.SignUrl)
+	//raft
+	r.POST("/raft/apply", NodeAuth, t.RaftApply)
+	//sync queue
+	admin := r.Group("/admin", t.Auth(common.AuthRoleAdmin))
+	{
+		admin.GET("/cluster", t.ClusterStatus)
+		admin.GET("/health", t.Health)
+		admin.GET("/access", t.GroupAccess)
+		admin.POST("/access", t.SetGroupAccess)
+		admin.GET("/keys", t.ApiKeys)
+		admin.POST("/keys", t.CreateApiKey)
+		admin.POST("/keys/delete", t.DeleteApiKey)
+		admin.POST("/storage/attr", t.StorageAttr)
+		admin.POST("/storage/drain", t.StorageState("draining"))
+		admin.GET("/storage/drain", t.DrainStatus)
+		admin.POST("/storage/readonly", t.StorageState("readonly"))
+		admin.POST("/storage/maintenance", t.StorageState("maintenance"))
+		admin.POST("/storage/resume", t.StorageState(""))
+		admin.POST("/decommission", t.StartDecommission)
+		admin.GET("/decommission", t.Decommissions)
+		admin.POST("/decommission/resume", t.ResumeDecommission)
+		admin.POST("/decommission/cancel", t.CancelDecommission)
+		admin.POST("/rebalance", t.Rebalance)
+		admin.GET("/rebalance", t.RebalanceStatus)
+		admin.GET("/sync/tasks", t.SyncTasks)
+		admin.POST("/sync/retry", t.SyncRetry)
+		admin.POST("/sync/purge", t.SyncPurge)
+	}
+
+	go t.migrateSyncErrLog()
 	if err := t.startTrackerTimerTask(); err != nil {
 		logger.Panic("Tracker定时任务启动失败")
 	}
 
-	err := r.Run(":" + config().Port)
+	err := listenAndServe(r)
 	if err != nil {
 		addr := net.JoinHostPort(config().Host, config().Port)
-		logger.Panic("Tracker服务启动失败", zap.String("addr", addr))
+		logger.Panic("Tracker服务启动失败", zap.String("addr", addr), zap.Error(err))
 	}
 }
 
@@ -79,39 +174,44 @@ func (t *Tracker) Start() {
 func (t *Tracker) startTrackerTimerTask() error {
 	cr := cron.New(cron.WithSeconds())
 
-	RepairSyncFail := func() {
-		iter := t.syncDB.Ldb.NewIterator(nil, nil)
-		for iter.Next() {
-			v := iter.Value()
-			var sfi model.SyncFileInfo
-			err := json.Unmarshal(v, &sfi)
-			if err != nil {
-				continue
-			}
-			g := t.GetGroup(sfi.Group)
-			if g == nil {
-				continue
-			}
-			if g.GetStorage(sfi.Dst).Status == 1 && g.GetStorage(sfi.Src).Status == 1 {
-				url := sfi.Dst + "/sync"
-				resp, err := util.HttpPost(url, sfi, nil, time.Second*10)
-				if err != nil || len(resp) <= 0 {
-					continue
-				}
-				var res model.RespResult
-				_ = json.Unmarshal(resp, &res)
-				if res.Status != common.Success {
-					continue
-				}
-				_ = t.syncDB.Delete(sfi.FileName + "@" + sfi.Action)
-			}
+	//10s 执行到期的同步任务
+	_, err := cr.AddJob("*/10 * * * * *", cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(t.RepairSyncFail)))
+	if err != nil {
+		return err
+	}
+	//10s 继续执行未完成的下线任务
+	_, err = cr.AddJob("*/10 * * * * *", cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(t.RunDecommissions)))
+	if err != nil {
+		return err
+	}
+	//5s 超时未收到心跳的storage标记离线
+	_, err = cr.AddFunc("*/5 * * * * *", t.ExpireStorages)
+	if err != nil {
+		return err
+	}
+	//主动健康检查
+	if spec := healthSpec(); spec != "" {
+		_, err = cr.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(t.ProbeStorages)))
+		if err != nil {
+			return err
 		}
 	}
-	//30min
-	_, err := cr.AddFunc("0 0/30 * * * *", RepairSyncFail)
+	//10min 清理过期上传会话
+	_, err = cr.AddFunc("0 */10 * * * *", t.cleanExpiredUploadRoutes)
 	if err != nil {
 		return err
 	}
+	//10s 继续执行未完成的跨group迁移
+	_, err = cr.AddJob("*/10 * * * * *", cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(t.RunRebalance)))
+	if err != nil {
+		return err
+	}
+	//跨group迁移
+	if spec := rebalanceSpec(); spec != "" {
+		if _, err = cr.AddFunc(spec, t.AutoRebalance); err != nil {
+			return err
+		}
+	}
 
 	cr.Start()
 	return nil
@@ -120,11 +220,14 @@ func (t *Tracker) startTrackerTimerTask() error {
 //StorageStatusReport 处理storage回报的信息
 func (t *Tracker) StorageStatusReport(c *gin.Context) {
 	var params struct {
-		Group      string `json:"group" binding:"required"`
-		HttpSchema string `json:"http_schema" binding:"required"`
-		Host       string `json:"host" binding:"required"`
-		Port       string `json:"port" binding:"required"`
-		Free       uint64 `json:"free" binding:"required"`
+		Group       string                 `json:"group" binding:"required"`
+		HttpSchema  string                 `json:"http_schema" binding:"required"`
+		Host        string                 `json:"host" binding:"required"`
+		Port        string                 `json:"port" binding:"required"`
+		Free        uint64                 `json:"free" binding:"required"`
+		Files       int64                  `json:"files"`
+		Bootstrap   *model.BootstrapInfo   `json:"bootstrap"`
+		AntiEntropy *model.AntiEntropyInfo `json:"anti_entropy"`
 	}
 	if err := c.ShouldBindJSON(&params); err != nil {
 		logger.Error("param binding fail", zap.String("url", "/status"))
@@ -142,19 +245,95 @@ func (t *Tracker) StorageStatusReport(c *gin.Context) {
 	}
 
 	sm := &StorageServer{
-		Group:      params.Group,
-		HttpSchema: params.HttpSchema,
-		Addr:       net.JoinHostPort(params.Host, params.Port),
-		Free:       params.Free,
-		Status:     common.StorageActive,
-		UpdateTime: time.Now().Unix(),
+		Group:       params.Group,
+		HttpSchema:  params.HttpSchema,
+		Addr:        net.JoinHostPort(params.Host, params.Port),
+		Free:        params.Free,
+		Files:       params.Files,
+		Bootstrap:   params.Bootstrap,
+		AntiEntropy: params.AntiEntropy,
+		Status:      common.StorageActive,
+		UpdateTime:  time.Now().Unix(),
 	}
 	//储存空间阈值
 	if sm.Free <= common.MinStorageSpace {
 		sm.Status = common.StorageNotEnoughSpace
 	}
 
+	//已下线的storage
+	if t.isRetired(sm.Group, sm.Addr) {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: "storage decommissioned",
+		})
+		return
+	}
+
+	//全量同步
+	reply := StorageStatusReply{Access: t.groupAccess(sm.Group)}
+	if group := t.GetGroup(sm.Group); group != nil {
+		if peer := t.bootstrapPeer(group, sm); peer != nil {
+			reply.BootstrapPeer = peer.HttpSchema + "://" + peer.Addr
+			logger.Info("storage bootstrap", zap.String("addr", sm.Addr), zap.String("peer", peer.Addr))
+		}
+	}
+	if reply.BootstrapPeer != "" || (sm.Bootstrap != nil && sm.Bootstrap.State != common.BootstrapDone) {
+		sm.Status = common.StorageSyncing
+	}
+	if err := t.reportStorage(sm); err != nil {
+		logger.Warn("storage status apply fail", zap.String("addr", sm.Addr), zap.Error(err))
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   reply,
+	})
+}
+
+//reportStorage 记录storage的心跳
+//心跳数据只记录在本tracker，未注册的storage经集群提交注册，已注册storage的状态由leader判定并只提交变化
+func (t *Tracker) reportStorage(sm *StorageServer) error {
+	//主动检查判定离线时忽略心跳
+	if t.healthDown(sm.Group, sm.Addr) {
+		sm.Status = common.StorageOffline
+	}
 	t.lock.Lock()
+	var old *StorageServer
+	if group := t.GetGroup(sm.Group); group != nil {
+		old = group.GetStorage(sm.Addr)
+	}
+	if old != nil {
+		//剩余空间变化后重新计算group容量
+		old.setReport(sm)
+		t.SetTrackerStatus()
+	}
+	t.lock.Unlock()
+
+	leader := t.cluster.IsLeader()
+	if old == nil || old.HttpSchema != sm.HttpSchema {
+		//follower注册的storage等待leader确认状态
+		if !leader {
+			sm.Status = common.StoragePending
+		}
+		return t.cluster.Apply(&Command{Op: cmdStorage, Storage: sm})
+	}
+	if !leader || old.Status == operatorStatus(sm.Status, old.Attr.State) {
+		return nil
+	}
+	return t.cluster.Apply(&Command{Op: cmdStorageStatus, Storage: &StorageServer{Group: sm.Group, Addr: sm.Addr, Status: sm.Status}})
+}
+
+//applyStorage 注册storage或更新storage的访问协议并重新计算group状态
+func (t *Tracker) applyStorage(sm *StorageServer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.isRetired(sm.Group, sm.Addr) {
+		return nil
+	}
 	//防止重复注册，覆盖注册的情况
 	//group未注册
 	if !t.IsExistGroup(sm.Group) {
@@ -164,36 +343,47 @@ func (t *Tracker) StorageStatusReport(c *gin.Context) {
 			Cap:      sm.Free,
 			Storages: make(map[string]*StorageServer),
 		}
-		_ = group.SaveOrUpdateStorage(sm)
 		_ = t.RegisterGroup(group)
 	}
 
 	//group已注册
 	group := t.GetGroup(sm.Group)
 	if group == nil {
-		return
+		return errors.New("no such group")
 	}
-	if err := group.SaveOrUpdateStorage(sm); err != nil {
-		return
+	if old := group.GetStorage(sm.Addr); old != nil {
+		old.HttpSchema = sm.HttpSchema
+		old.Status = operatorStatus(sm.Status, old.Attr.State)
+		sm = old
+	} else {
+		sm.Status = operatorStatus(sm.Status, sm.Attr.State)
+		if err := group.SaveOrUpdateStorage(sm); err != nil {
+			return err
+		}
 	}
+	t.saveStorageRecord(sm)
 	t.SetTrackerStatus()
-	t.lock.Unlock()
+	return nil
 }
 
-//SelectStorageIPHash ip hash选择storage
-func (t *Tracker) SelectStorageIPHash(ip string, g *Group) (s *StorageServer, err error) {
-	as := make([]*StorageServer, 0)
-	for _, g := range g.GetStorages() {
-		if g.Status == common.StorageActive {
-			as = append(as, g)
-		}
+//bootstrapPeer 判断storage是否需要全量同步 需要时返回源storage
+//文件目录为空、新加入或重新上线且文件数少于其他storage，以及上次全量同步失败的storage需要全量同步
+func (t *Tracker) bootstrapPeer(g *Group, sm *StorageServer) *StorageServer {
+	if sm.Bootstrap != nil && sm.Bootstrap.State == common.BootstrapRunning {
+		return nil
+	}
+	failed := sm.Bootstrap != nil && sm.Bootstrap.State == common.BootstrapFailed
+	empty := sm.Bootstrap == nil && sm.Files == 0
+	old := g.GetStorage(sm.Addr)
+	rejoin := old == nil || old.Status == common.StorageOffline || old.Status == common.StorageSyncing
+	if !failed && !empty && !rejoin {
+		return nil
 	}
-	if len(as) == 0 {
-		return nil, errors.New("no available storage for group")
+	peer := g.BootstrapPeer(sm.Addr)
+	if peer == nil || (!failed && peer.Files <= sm.Files) {
+		return nil
 	}
-	//ip hash
-	hashcode := int(t.hash([]byte(ip)))
-	return as[hashcode%len(as)], err
+	return peer
 }
 
 //GetGroups 获取所有group
@@ -236,31 +426,23 @@ func (t *Tracker) RegisterGroup(g *Group) error {
 }
 
 //SelectGroupForUpload 选择上传的group
-func (t *Tracker) SelectGroupForUpload() (*Group, error) {
-	gs := make([]*Group, 0)
-	t.mu.RLock()
-	for _, g := range t.groups {
-		if g.Status == common.GroupActive {
-			gs = append(gs, g)
-		}
-	}
-	t.mu.RUnlock()
+func (t *Tracker) SelectGroupForUpload(r *http.Request) (*Group, error) {
+	gs := t.activeGroups()
 	if len(gs) == 0 {
 		return nil, errors.New("no available group")
 	}
-
-	//按容量降序
-	sort.Slice(gs, func(i, j int) bool {
-		return gs[i].Cap > gs[i].Cap
-	})
-	//返回容量最大的group
-	return gs[0], nil
+	return t.groupSelector.Select(r, gs)
 }
 
 //QuickUpload api 小文件快传
 func (t *Tracker) QuickUpload(c *gin.Context) {
+	wc := t.beginWriteConcern(c)
+	if wc == nil {
+		return
+	}
+	defer wc.finish(c)
 	//获取group
-	group, err := t.SelectGroupForUpload()
+	group, err := t.SelectGroupForUpload(c.Request)
 	if err != nil {
 		logger.Error(err.Error())
 		c.JSON(http.StatusOK, model.RespResult{
@@ -270,7 +452,7 @@ func (t *Tracker) QuickUpload(c *gin.Context) {
 		return
 	}
 	//获取storage
-	s, err := t.SelectStorageIPHash(c.ClientIP(), group)
+	s, err := t.SelectStorageForUpload(c.ClientIP(), group)
 	if err != nil {
 		logger.Error(err.Error())
 		c.JSON(http.StatusOK, model.RespResult{
@@ -284,9 +466,8 @@ func (t *Tracker) QuickUpload(c *gin.Context) {
 	uuid := util.GenFileUUID()
 	c.Request.Header.Set(common.HeaderFileUUID, uuid)
 
-	//反向代理
-	p := NewTrackerProxy(config().HttpSchema, s.Addr, group.Name, t, c)
-	if err = t.httpProxy(p, c); err != nil {
+	//反向代理 storage不可达时切换到其他storage
+	if s, err = t.httpProxyFailover(c, group, s, (*StorageServer).Writable); err != nil {
 		logger.Error(err.Error())
 		c.JSON(http.StatusOK, model.RespResult{
 			Status:  common.Fail,
@@ -296,67 +477,72 @@ func (t *Tracker) QuickUpload(c *gin.Context) {
 	}
 
 	//文件同步
-	if c.Writer.Header().Get(common.HeaderFileUploadRes) == strconv.Itoa(common.Success) {
-		fullPath := c.Writer.Header().Get(common.HeaderFilePath)
-		hash := c.Writer.Header().Get(common.HeaderFileHash)
-		filePath, filename := util.ParseHeaderFilePath(fullPath)
-		storages := t.groups[group.Name].GetStorages()
-		for i := 0; i < len(storages); i++ {
-			server := storages[i]
-			if server.Addr == s.Addr {
-				continue
-			}
-			go func(*StorageServer) {
-				info := model.SyncFileInfo{
-					Src:      s.HttpSchema + "://" + s.Addr,
-					Dst:      server.HttpSchema + "://" + server.Addr,
-					FileId:   uuid,
-					FilePath: filePath,
-					FileName: filename,
-					FileHash: hash,
-					Action:   common.SyncAdd,
-					Group:    group.Name,
-				}
-				logger.Info("sync-file info", zap.Any("info", info))
-				t.SyncFile(server, info)
-			}(server)
+	t.syncUploadedFile(c, group, s, uuid)
+}
+
+//syncUploadedFile 上传成功后将文件同步到group内的其他storage 按写入级别等待副本确认
+func (t *Tracker) syncUploadedFile(c *gin.Context, group *Group, s *StorageServer, uuid string) {
+	if c.Writer.Header().Get(common.HeaderFileUploadRes) != strconv.Itoa(common.Success) {
+		return
+	}
+	t.fileGroups.Store(uuid, group.Name)
+	fullPath := c.Writer.Header().Get(common.HeaderFilePath)
+	hash := c.Writer.Header().Get(common.HeaderFileHash)
+	filePath, filename := util.ParseHeaderFilePath(fullPath)
+	infos := make(map[*StorageServer]model.SyncFileInfo)
+	for _, server := range group.GetStorages() {
+		if server.Addr == s.Addr {
+			continue
+		}
+		info := model.SyncFileInfo{
+			Src:      s.HttpSchema + "://" + s.Addr,
+			Dst:      server.HttpSchema + "://" + server.Addr,
+			FileId:   uuid,
+			FilePath: filePath,
+			FileName: filename,
+			FileHash: hash,
+			Action:   common.SyncAdd,
+			Group:    group.Name,
 		}
+		logger.Info("sync-file info", zap.Any("info", info))
+		infos[server] = info
 	}
+	t.waitReplicas(c, infos)
 }
 
-//httpProxy tracker 反向代理 //todo 处理502请求2 redo proxy
+//httpProxy tracker 反向代理
 func (t *Tracker) httpProxy(tp *TrackerProxy, c *gin.Context) error {
 	return tp.HttpProxy(c.Writer, c.Request, tp.AbortErrorHandler)
 }
 
-//SyncFile 同步函数
-func (t *Tracker) SyncFile(sm *StorageServer, sync model.SyncFileInfo) {
-	data, err := json.Marshal(sync)
-	if err != nil {
-		return
-	}
-	if sm.Status != common.StorageActive {
-		_ = t.syncDB.Put(sync.FileName+"@"+sync.Action, data)
-		return
-	}
-	url := sm.HttpSchema + "://" + sm.Addr + "/sync"
-	//在大文件下这个方法完全不可行
-	resp, err := util.HttpPost(url, sync, nil, time.Second*30)
-	if err != nil || len(resp) == 0 {
-		_ = t.syncDB.Put(sync.FileName+"@"+sync.Action, data)
-		return
-	}
-
-	//res code写入日志
-	var res model.RespResult
-	err = json.Unmarshal(resp, &res)
-	if err != nil {
-		_ = t.syncDB.Put(sync.FileName+"@"+sync.Action, data)
-		return
-	}
-	if res.Status != common.Success {
-		_ = t.syncDB.Put(sync.FileName+"@"+sync.Action, data)
-		return
+//httpProxyFailover tracker 反向代理 storage不可达时依次切换到group内其他usable的storage重试
+//请求体已有数据发送到storage时不再重试 返回最终处理请求的storage
+func (t *Tracker) httpProxyFailover(c *gin.Context, group *Group, s *StorageServer, usable func(*StorageServer) bool) (*StorageServer, error) {
+	attempts := config().Tracker.ProxyAttempts
+	if attempts <= 0 {
+		attempts = common.DefaultProxyAttempts
+	}
+	body := &countingBody{ReadCloser: c.Request.Body}
+	c.Request.Body = body
+
+	tried := make(map[string]bool)
+	for i := 1; ; i++ {
+		tried[s.Addr] = true
+		tp := NewTrackerProxy(s.HttpSchema, s.Addr, group.Name, t, c)
+		if err := tp.HttpProxy(c.Writer, c.Request, tp.RetryErrorHandler); err != nil {
+			return s, err
+		}
+		if tp.Err == nil {
+			return s, nil
+		}
+		next := group.NextStorage(tried, usable)
+		if i >= attempts || next == nil || body.n > 0 {
+			logger.Error("proxy fail", zap.String("addr", s.Addr), zap.Int("attempt", i), zap.Error(tp.Err))
+			tp.writeBadGateway(c.Writer, tp.Err)
+			return s, nil
+		}
+		logger.Warn("proxy failover", zap.String("from", s.Addr), zap.String("to", next.Addr), zap.Error(tp.Err))
+		s = next
 	}
 }
 
@@ -373,9 +559,26 @@ func (t *Tracker) Delete(c *gin.Context) {
 			Status:  common.ParamBindFail,
 			Message: "参数绑定失败",
 		})
+		return
 	}
 	logger.Info("delete info", zap.Any("info", deleteFile))
+	deleteFile.Group, deleteFile.File = t.resolveRedirect(deleteFile.Group, deleteFile.File)
 	g := t.GetGroup(deleteFile.Group)
+	if g == nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: "no such group",
+		})
+		return
+	}
+	if exist, err := t.fileExists(g, deleteFile.FileID, deleteFile.File); err != nil || !exist {
+		res := model.RespResult{Status: common.FileNotFound, Message: "no such file"}
+		if err != nil {
+			res = model.RespResult{Status: common.Fail, Message: err.Error()}
+		}
+		c.JSON(http.StatusOK, res)
+		return
+	}
 	for _, s := range g.GetStorages() {
 		server := s
 		go func() {
@@ -389,27 +592,7 @@ func (t *Tracker) Delete(c *gin.Context) {
 				Action:   common.SyncDelete,
 				Group:    g.Name,
 			}
-			url := server.HttpSchema + "://" + server.Addr + "/sync"
-			data, _ := json.Marshal(info)
-
-			//跳过下线主机
-			if server.Status == common.StorageOffline {
-				_ = t.syncDB.Put(strings.Join([]string{info.FileName, common.SyncDelete}, "@"), data)
-				return
-			}
-
-			res, err := util.HttpPost(url, info, nil, time.Second*10)
-			if err != nil {
-				_ = t.syncDB.Put(info.FileName+"@"+common.SyncDelete, data)
-				return
-			}
-			var resp model.RespResult
-			_ = json.Unmarshal(res, &resp)
-
-			//error log
-			if resp.Status != common.Success {
-				_ = t.syncDB.Put(strings.Join([]string{info.FileName, common.SyncDelete}, "@"), data)
-			}
+			t.SyncFile(server, info)
 		}()
 	}
 	c.JSON(http.StatusOK, model.RespResult{
@@ -418,23 +601,18 @@ func (t *Tracker) Delete(c *gin.Context) {
 	})
 }
 
-//SetTrackerStatus 计算整个tracker以及所有group的状态
+//SetTrackerStatus 按storage的状态计算所有group的状态 storage的离线判定见ExpireStorages
 func (t *Tracker) SetTrackerStatus() {
 	gs := t.GetGroups()
 	for _, group := range gs {
-		vs := make([]*StorageServer, 0)
+		servable := 0
 		for _, s := range group.GetStorages() {
-			if s.Status == common.StorageActive {
-				//10次没有接收到storage report，认为已离线
-				if time.Now().Unix()-s.UpdateTime > 5*10 {
-					s.Status = common.StorageOffline
-				} else {
-					vs = append(vs, s)
-				}
+			if s.Servable() {
+				servable++
 			}
 		}
 		//没有可用的storage
-		if len(vs) == 0 {
+		if servable == 0 {
 			group.Status = common.GroupUnavailable
 			group.Cap = 0
 		} else {
@@ -470,6 +648,33 @@ func (t *Tracker) GroupStatus(c *gin.Context) {
 	})
 }
 
+//GroupDivergence api 获取group副本一致性统计
+func (t *Tracker) GroupDivergence(c *gin.Context) {
+	if g := c.Query("group"); g != "" {
+		group := t.GetGroup(g)
+		if group == nil {
+			c.JSON(http.StatusOK, model.RespResult{
+				Status:  common.Fail,
+				Message: "no such group",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, model.RespResult{
+			Status: common.Success,
+			Data:   group.Divergence(),
+		})
+		return
+	}
+	ds := make([]GroupDivergence, 0)
+	for _, group := range t.GetGroups() {
+		ds = append(ds, group.Divergence())
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   ds,
+	})
+}
+
 //SyncErrorMsg 同步storage的err log
 func (t *Tracker) SyncErrorMsg(c *gin.Context) {
 	var errMsg struct {
@@ -497,14 +702,33 @@ func (t *Tracker) Download(c *gin.Context) {
 		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
 		return
 	}
+	//已迁移到其他group的文件
+	g, file := t.resolveRedirect(g, c.Query("file"))
+	if g != c.Query("group") || file != strings.TrimPrefix(c.Query("file"), "/") {
+		q := c.Request.URL.Query()
+		q.Set("group", g)
+		q.Set("file", file)
+		c.Request.URL.RawQuery = q.Encode()
+	}
 	group := t.GetGroup(g)
 	if group == nil || group.Status != common.GroupActive {
 		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no available group"})
 		return
 	}
-	if s, err := t.SelectStorageIPHash(c.ClientIP(), group); err == nil {
-		proxy := NewTrackerProxy(s.HttpSchema, s.Addr, s.Group, t, c)
-		if err := t.httpProxy(proxy, c); err != nil {
+	if s, err := t.SelectStorageForDownload(c.ClientIP(), group); err == nil {
+		if config().Tracker.DownloadMode == common.DownloadModeRedirect {
+			t.redirectDownload(c, s, file)
+			return
+		}
+		//代理请求同样携带签名，storage可拒绝未经tracker的下载
+		if token := t.signDownload(s.Group, file); token != nil {
+			q := c.Request.URL.Query()
+			for k, v := range token {
+				q[k] = v
+			}
+			c.Request.URL.RawQuery = q.Encode()
+		}
+		if _, err := t.httpProxyFailover(c, group, s, (*StorageServer).Servable); err != nil {
 			c.JSON(http.StatusOK, model.RespResult{
 				Status:  common.Fail,
 				Message: err.Error(),
@@ -515,3 +739,33 @@ func (t *Tracker) Download(c *gin.Context) {
 		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no available group or storage"})
 	}
 }
+
+//redirectDownload 重定向到storage的静态文件地址，下载流量不再经过tracker
+func (t *Tracker) redirectDownload(c *gin.Context, s *StorageServer, file string) {
+	if file == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	target := fileStaticUrl(s.HttpSchema, s.Addr, s.Group, (&url.URL{Path: file}).EscapedPath())
+	if token := t.signDownload(s.Group, file); token != nil {
+		target += "?" + token.Encode()
+	}
+	code := config().Tracker.RedirectStatus
+	if code != http.StatusFound && code != http.StatusTemporaryRedirect {
+		code = http.StatusFound
+	}
+	c.Redirect(code, target)
+}
+
+//signDownload 生成短期有效的下载签名 未配置密钥时返回nil
+func (t *Tracker) signDownload(group, file string) url.Values {
+	secret := config().RedirectSecret
+	if secret == "" {
+		return nil
+	}
+	ttl := config().Tracker.RedirectTokenTTL
+	if ttl <= 0 {
+		ttl = common.DefaultRedirectTokenTTL
+	}
+	return util.SignDownload(secret, group+"/"+file, "", time.Duration(ttl)*time.Second)
+}
@@ -0,0 +1,184 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//group访问模式与签名下载地址
+//public的group任何人都可以通过storage的静态地址下载，private的group只提供携带tracker签名的请求。
+//访问模式保存在access库中，未单独设置的group使用default_access，storage通过心跳回复获取所在group的访问模式。
+//签名下载地址包含过期时间，可绑定客户端ip，签名密钥为redirect_secret
+
+const accessDBName = "access"
+
+//groupAccess group的访问模式
+func (t *Tracker) groupAccess(group string) string {
+	if data, err := t.accessDB.Get(group); err == nil && len(data) > 0 {
+		return string(data)
+	}
+	if config().Tracker.DefaultAccess == common.AccessPrivate {
+		return common.AccessPrivate
+	}
+	return common.AccessPublic
+}
+
+//GroupAccess api 所有group的访问模式
+func (t *Tracker) GroupAccess(c *gin.Context) {
+	access := make(map[string]*model.GroupAccess)
+	for _, g := range t.GetGroups() {
+		access[g.Name] = &model.GroupAccess{Group: g.Name, Access: t.groupAccess(g.Name), Default: true}
+	}
+	_ = t.accessDB.Range("", func(key, value []byte) bool {
+		access[string(key)] = &model.GroupAccess{Group: string(key), Access: string(value)}
+		return true
+	})
+	res := make([]model.GroupAccess, 0, len(access))
+	for _, a := range access {
+		res = append(res, *a)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Group < res[j].Group
+	})
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   res,
+	})
+}
+
+//SetGroupAccess api 设置group的访问模式 access: public||private 为空时恢复为default_access
+func (t *Tracker) SetGroupAccess(c *gin.Context) {
+	var params struct {
+		Group  string `json:"group" form:"group" binding:"required"`
+		Access string `json:"access" form:"access"`
+	}
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	var err error
+	switch params.Access {
+	case "":
+		err = t.accessDB.Delete(params.Group)
+	case common.AccessPrivate:
+		//没有签名密钥时无法签发下载地址
+		if config().RedirectSecret == "" {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "redirect_secret required for private group"})
+			return
+		}
+		err = t.accessDB.Put(params.Group, []byte(params.Access))
+	case common.AccessPublic:
+		err = t.accessDB.Put(params.Group, []byte(params.Access))
+	default:
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: "invalid access: " + params.Access})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	logger.Info("group access changed", zap.String("group", params.Group), zap.String("access", t.groupAccess(params.Group)),
+		zap.String("by", c.GetString(authKeyContext)))
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   model.GroupAccess{Group: params.Group, Access: t.groupAccess(params.Group), Default: params.Access == ""},
+	})
+}
+
+//signedUrlTTL 签名下载地址的有效期 超过最大有效期时使用最大有效期
+func signedUrlTTL(ttl int64) int64 {
+	if ttl <= 0 {
+		if ttl = config().Tracker.SignedUrlTTL; ttl <= 0 {
+			ttl = common.DefaultSignedUrlTTL
+		}
+	}
+	max := config().Tracker.SignedUrlMaxTTL
+	if max <= 0 {
+		max = common.DefaultSignedUrlMaxTTL
+	}
+	if ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+//SignUrl api 签发storage静态地址的签名下载地址
+//通过group与file或file_id指定文件，ttl为有效期(秒)，ip为绑定的客户端ip，bind_ip为true时绑定请求方ip
+func (t *Tracker) SignUrl(c *gin.Context) {
+	var params struct {
+		Group  string `form:"group"`
+		File   string `form:"file"`
+		FileId string `form:"file_id"`
+		TTL    int64  `form:"ttl"`
+		Ip     string `form:"ip"`
+		BindIp bool   `form:"bind_ip"`
+	}
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	secret := config().RedirectSecret
+	if secret == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "redirect_secret not configured"})
+		return
+	}
+	var s *StorageServer
+	var file string
+	if params.FileId != "" {
+		group, storage, fi, err := t.locateFile(params.FileId)
+		if err != nil {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.FileNotFound, Message: err.Error()})
+			return
+		}
+		s, params.Group, file = storage, group.Name, strings.TrimPrefix(fi.Path, "/")
+	} else {
+		if params.Group == "" || params.File == "" {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: "group and file or file_id required"})
+			return
+		}
+		params.Group, file = t.resolveRedirect(params.Group, params.File)
+		group := t.GetGroup(params.Group)
+		if group == nil || group.Status != common.GroupActive {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no available group"})
+			return
+		}
+		var err error
+		if s, err = t.SelectStorageForDownload(c.ClientIP(), group); err != nil {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+			return
+		}
+	}
+	ip := params.Ip
+	if ip == "" && params.BindIp {
+		ip = c.ClientIP()
+	}
+	ttl := time.Duration(signedUrlTTL(params.TTL)) * time.Second
+	q := util.SignDownload(secret, params.Group+"/"+file, ip, ttl)
+	res := model.SignedUrl{
+		Url:   fileStaticUrl(s.HttpSchema, s.Addr, params.Group, (&url.URL{Path: file}).EscapedPath()) + "?" + q.Encode(),
+		Group: params.Group,
+		Path:  file,
+		Ip:    ip,
+	}
+	res.Expire, _ = strconv.ParseInt(q.Get("expire"), 10, 64)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   res,
+	})
+}
@@ -0,0 +1,355 @@
+package svc
+
+import (
+	"bytes"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//api key认证
+//开启auth_enable后，除storage回报与集群内部接口外的请求需携带以下请求头，节点凭证只能访问/g/status等节点使用的接口：
+//Egg-Dfs-Key、Egg-Dfs-Timestamp(unix秒)、Egg-Dfs-Nonce、Egg-Dfs-Signature
+//以及Egg-Dfs-Content-Sha256(请求体sha256的hex编码)，签名为hmac-sha256(secret, method\npath\n排序后的query\n请求体sha256\ntimestamp\nnonce)的hex编码。
+//时间戳与tracker相差超过auth_skew秒或nonce在有效期内重复时拒绝。nonce只记录在收到请求的tracker上，
+//多个tracker时同一请求在auth_skew内仍可能被发往其他tracker重放，需要防重放的请求应缩短auth_skew或固定发往同一tracker。
+//请求体在代理前完成校验，超过1MB或长度未知的请求体暂存到临时文件，超过auth_body_max时拒绝。
+//key来自配置文件的api_keys以及通过接口创建的apikey库，配置文件中的key不能通过接口删除
+
+const apiKeyDBName = "apikey"
+
+//authKeyContext gin上下文中保存认证通过的key id
+const authKeyContext = "auth_key"
+
+//authRoles 角色权限 数值大的角色包含数值小的角色的权限
+var authRoles = map[string]int{
+	common.AuthRoleRead:  1,
+	common.AuthRoleWrite: 2,
+	common.AuthRoleAdmin: 3,
+}
+
+//nonceCache 当前tracker有效期内使用过的nonce 不在tracker之间共享
+type nonceCache struct {
+	mu    sync.Mutex
+	seen  map[string]int64 //key id:nonce -> 过期时间
+	purge int64
+}
+
+//add 记录nonce 有效期内已存在时返回false
+func (n *nonceCache) add(nonce string, expire, now int64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.seen == nil {
+		n.seen = make(map[string]int64)
+	}
+	if now >= n.purge {
+		for k, exp := range n.seen {
+			if exp < now {
+				delete(n.seen, k)
+			}
+		}
+		n.purge = now + 60
+	}
+	if exp, ok := n.seen[nonce]; ok && exp >= now {
+		return false
+	}
+	n.seen[nonce] = expire
+	return true
+}
+
+func authSkew() int64 {
+	if skew := config().Tracker.AuthSkew; skew > 0 {
+		return skew
+	}
+	return common.DefaultAuthSkew
+}
+
+//getApiKey 查找api key 配置文件中的key优先
+func (t *Tracker) getApiKey(id string) (*model.ApiKey, error) {
+	for _, k := range config().Tracker.ApiKeys {
+		if k.Id == id {
+			return &model.ApiKey{Id: k.Id, Secret: k.Secret, Role: k.Role, Static: true}, nil
+		}
+	}
+	data, err := t.apiKeyDB.Get(id)
+	if err != nil {
+		return nil, errors.New("no such api key")
+	}
+	var key model.ApiKey
+	if err = json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+//Auth 校验api key签名以及角色权限 未开启认证时直接通过
+//节点凭证不能通过该认证，需要节点访问的接口使用NodeOrAuth
+func (t *Tracker) Auth(role string) gin.HandlerFunc {
+	need := authRoles[role]
+	return func(c *gin.Context) {
+		if !config().Tracker.AuthEnable {
+			c.Next()
+			return
+		}
+		t.apiKeyAuth(c, need)
+	}
+}
+
+//NodeOrAuth 集群内节点的请求按节点间认证校验 如storage查询group状态 其余请求同Auth
+func (t *Tracker) NodeOrAuth(role string) gin.HandlerFunc {
+	need := authRoles[role]
+	return func(c *gin.Context) {
+		if !config().Tracker.AuthEnable {
+			c.Next()
+			return
+		}
+		if nodeRequest(c.Request) {
+			NodeAuth(c)
+			return
+		}
+		t.apiKeyAuth(c, need)
+	}
+}
+
+//apiKeyAuth 校验api key签名 角色权限不足need时拒绝
+func (t *Tracker) apiKeyAuth(c *gin.Context, need int) {
+	key, err := t.authenticate(c.Request)
+	if err != nil {
+		logger.Warn("auth fail", zap.String("url", c.Request.URL.Path), zap.String("ip", c.ClientIP()), zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, model.RespResult{
+			Status:  common.AuthFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if authRoles[key.Role] < need {
+		c.AbortWithStatusJSON(http.StatusForbidden, model.RespResult{
+			Status:  common.PermissionDenied,
+			Message: "permission denied",
+		})
+		return
+	}
+	c.Set(authKeyContext, key.Id)
+	//暂存到临时文件的请求体在请求结束时删除
+	defer c.Request.Body.Close()
+	c.Next()
+}
+
+//authenticate 校验请求签名 返回请求使用的key
+func (t *Tracker) authenticate(r *http.Request) (*model.ApiKey, error) {
+	id := r.Header.Get(common.HeaderAuthKey)
+	timestamp := r.Header.Get(common.HeaderAuthTimestamp)
+	nonce := r.Header.Get(common.HeaderAuthNonce)
+	signature := r.Header.Get(common.HeaderAuthSignature)
+	bodyHash := r.Header.Get(common.HeaderAuthContentHash)
+	if id == "" || timestamp == "" || nonce == "" || signature == "" || bodyHash == "" {
+		return nil, errors.New("missing api key signature")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	now, skew := time.Now().Unix(), authSkew()
+	if ts < now-skew || ts > now+skew {
+		return nil, errors.New("request expired")
+	}
+	key, err := t.getApiKey(id)
+	if err != nil {
+		return nil, errors.New("invalid api key")
+	}
+	if !util.VerifyRequest(key.Secret, signature, r.Method, r.URL.Path, r.URL.Query().Encode(), bodyHash, timestamp, nonce) {
+		return nil, errors.New("invalid signature")
+	}
+	if err = verifyBody(r, bodyHash); err != nil {
+		return nil, err
+	}
+	//签名通过后再记录nonce 防止伪造的请求占用nonce
+	if !t.nonces.add(id+":"+nonce, ts+skew, now) {
+		return nil, errors.New("replayed request")
+	}
+	return key, nil
+}
+
+//verifyBody 校验请求体与签名中的sha256一致
+//较小的请求体读取到内存后校验，上传等较大或长度未知的请求体暂存到临时文件后校验，校验通过才继续代理
+func verifyBody(r *http.Request, bodyHash string) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		if bodyHash != util.BodyHash(nil) {
+			return util.ErrBodyHashMismatch
+		}
+		return nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > maxNodeBody {
+		return spoolBody(r, bodyHash)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if util.BodyHash(body) != bodyHash {
+		return util.ErrBodyHashMismatch
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+//spoolBody 将请求体写入临时文件并校验sha256 超过auth_body_max时拒绝
+//校验通过后请求体替换为临时文件，关闭时删除
+func spoolBody(r *http.Request, bodyHash string) error {
+	max := authBodyMax()
+	if r.ContentLength > max {
+		return errors.New("request body too large")
+	}
+	if err := os.MkdirAll(tmpDir(), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(tmpDir(), "auth-body-")
+	if err != nil {
+		return err
+	}
+	body := &spooledBody{File: f}
+	n, err := io.Copy(f, io.LimitReader(util.VerifyBodyReader(r.Body, bodyHash), max+1))
+	if err == nil && n > max {
+		err = errors.New("request body too large")
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = body.Close()
+		return err
+	}
+	//长度已知 转发时不再使用chunked编码
+	r.Body, r.ContentLength, r.TransferEncoding = body, n, nil
+	return nil
+}
+
+//spooledBody 暂存在临时文件中的请求体 关闭时删除文件
+type spooledBody struct {
+	*os.File
+	once sync.Once
+}
+
+func (b *spooledBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		err = b.File.Close()
+		_ = os.Remove(b.File.Name())
+	})
+	return err
+}
+
+//authBodyMax 暂存请求体的最大长度 单位字节
+func authBodyMax() int64 {
+	if max := config().Tracker.AuthBodyMax; max > 0 {
+		return max << 20
+	}
+	return common.DefaultAuthBodyMax << 20
+}
+
+//CreateApiKey api 创建api key 密钥只在创建时返回 id为空时自动生成
+func (t *Tracker) CreateApiKey(c *gin.Context) {
+	var params struct {
+		Id   string `json:"id" form:"id"`
+		Role string `json:"role" form:"role" binding:"required"`
+	}
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if _, ok := authRoles[params.Role]; !ok {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: "invalid role: " + params.Role})
+		return
+	}
+	if params.Id == "" {
+		params.Id = util.RandomHex(8)
+	}
+	if _, err := t.getApiKey(params.Id); err == nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "api key already exists"})
+		return
+	}
+	key := model.ApiKey{
+		Id:         params.Id,
+		Secret:     util.RandomHex(32),
+		Role:       params.Role,
+		CreateTime: time.Now().Unix(),
+	}
+	data, _ := json.Marshal(key)
+	if err := t.apiKeyDB.Put(key.Id, data); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	logger.Info("api key created", zap.String("id", key.Id), zap.String("role", key.Role), zap.String("by", c.GetString(authKeyContext)))
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   key,
+	})
+}
+
+//ApiKeys api 所有api key 不返回密钥
+func (t *Tracker) ApiKeys(c *gin.Context) {
+	keys := make([]model.ApiKey, 0)
+	for _, k := range config().Tracker.ApiKeys {
+		keys = append(keys, model.ApiKey{Id: k.Id, Role: k.Role, Static: true})
+	}
+	_ = t.apiKeyDB.Range("", func(key, value []byte) bool {
+		var k model.ApiKey
+		if err := json.Unmarshal(value, &k); err == nil {
+			k.Secret = ""
+			keys = append(keys, k)
+		}
+		return true
+	})
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Id < keys[j].Id
+	})
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   keys,
+	})
+}
+
+//DeleteApiKey api 删除通过接口创建的api key
+func (t *Tracker) DeleteApiKey(c *gin.Context) {
+	var params struct {
+		Id string `json:"id" form:"id" binding:"required"`
+	}
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	key, err := t.getApiKey(params.Id)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	if key.Static {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "api key in config can not be deleted"})
+		return
+	}
+	if err = t.apiKeyDB.Delete(key.Id); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	logger.Info("api key deleted", zap.String("id", key.Id), zap.String("by", c.GetString(authKeyContext)))
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
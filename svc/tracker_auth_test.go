@@ -0,0 +1,64 @@
+package svc
+
+import (
+	"bytes"
+	"eggdfs/util"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyBody(t *testing.T) {
+	defer setTmpDir(t)()
+	cfg := config()
+	old := cfg.Tracker.AuthBodyMax
+	defer func() {
+		cfg.Tracker.AuthBodyMax = old
+	}()
+	cfg.Tracker.AuthBodyMax = 2
+
+	small := []byte("file_id=1")
+	large := bytes.Repeat([]byte("a"), maxNodeBody+1)
+	huge := bytes.Repeat([]byte("a"), 2<<20+1)
+	cases := []struct {
+		name    string
+		body    []byte
+		hash    []byte
+		chunked bool //长度未知
+		err     bool
+	}{
+		{"empty", nil, nil, false, false},
+		{"small", small, small, false, false},
+		{"small mismatch", small, []byte("file_id=2"), false, true},
+		{"large", large, large, false, false},
+		{"large mismatch", large, small, false, true},
+		{"chunked", small, small, true, false},
+		{"chunked mismatch", large, small, true, true},
+		{"too large", huge, huge, false, true},
+		{"chunked too large", huge, huge, true, true},
+	}
+	for _, tc := range cases {
+		r, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/upload", bytes.NewReader(tc.body))
+		if tc.chunked {
+			r.ContentLength = -1
+		}
+		err := verifyBody(r, util.BodyHash(tc.hash))
+		if (err != nil) != tc.err {
+			t.Errorf("%s: err %v", tc.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		//校验后的请求体可以完整读取
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if !bytes.Equal(data, tc.body) || r.ContentLength != int64(len(tc.body)) {
+			t.Errorf("%s: body %d bytes content length %d", tc.name, len(data), r.ContentLength)
+		}
+	}
+	//暂存的临时文件已删除
+	if files, _ := ioutil.ReadDir(tmpDir()); len(files) > 0 {
+		t.Errorf("%d spooled files left", len(files))
+	}
+}
@@ -0,0 +1,216 @@
+package svc
+
+import (
+	"bytes"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//写入级别
+//上传请求可通过请求头Egg-Dfs-Write-Concern或参数write_concern指定，未指定时使用配置的write_concern
+//ONE: 一个storage保存成功即返回，其余副本异步同步，不缓存响应
+//QUORUM||ALL: 缓存storage的响应，同步到group内可同步的多数或全部storage并校验md5后再返回，响应中返回确认的副本数与需要的副本数
+
+const ctxWriteConcern = "write_concern"
+
+type writeConcern struct {
+	level    string
+	orig     gin.ResponseWriter
+	buf      *bufferedWriter
+	replicas int
+	required int
+}
+
+//beginWriteConcern 解析写入级别并缓存之后的响应 参数错误时返回nil
+func (t *Tracker) beginWriteConcern(c *gin.Context) *writeConcern {
+	level := c.GetHeader(common.HeaderWriteConcern)
+	if level == "" {
+		level = c.Query("write_concern")
+	}
+	if level == "" {
+		level = config().Tracker.WriteConcern
+	}
+	level = strings.ToUpper(level)
+	switch level {
+	case "":
+		level = common.WriteConcernOne
+	case common.WriteConcernOne, common.WriteConcernQuorum, common.WriteConcernAll:
+	default:
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: "invalid write concern: " + level,
+		})
+		return nil
+	}
+	wc := &writeConcern{level: level}
+	c.Set(ctxWriteConcern, wc)
+	if level == common.WriteConcernOne {
+		return wc
+	}
+	wc.orig = c.Writer
+	wc.buf = &bufferedWriter{ResponseWriter: c.Writer, header: make(http.Header)}
+	c.Writer = wc.buf
+	return wc
+}
+
+//requiredReplicas 写入级别需要确认的副本数 n为可保存副本的storage数 至少为1
+func (wc *writeConcern) requiredReplicas(n int) int {
+	if n < 1 {
+		n = 1
+	}
+	switch wc.level {
+	case common.WriteConcernAll:
+		return n
+	case common.WriteConcernQuorum:
+		return n/2 + 1
+	}
+	return 1
+}
+
+//finish 将缓存的响应写回客户端 上传成功时附带副本数，副本数不足时返回WriteConcernFail
+//ONE没有缓存响应 不做处理
+func (wc *writeConcern) finish(c *gin.Context) {
+	if wc.buf == nil {
+		return
+	}
+	c.Writer = wc.orig
+	header := c.Writer.Header()
+	for k, v := range wc.buf.header {
+		header[k] = v
+	}
+	body := wc.buf.body.Bytes()
+	if wc.replicas > 0 {
+		header.Set(common.HeaderReplicas, strconv.Itoa(wc.replicas))
+		if data, ok := wc.rewriteBody(body); ok {
+			body = data
+			header.Del("Content-Length")
+		}
+	}
+	c.Writer.WriteHeader(wc.buf.Status())
+	_, _ = c.Writer.Write(body)
+}
+
+//rewriteBody 在json响应的data中加入确认的副本数与需要的副本数
+func (wc *writeConcern) rewriteBody(body []byte) ([]byte, bool) {
+	var res map[string]interface{}
+	if len(body) == 0 || json.Unmarshal(body, &res) != nil {
+		return nil, false
+	}
+	if data, ok := res["data"].(map[string]interface{}); ok {
+		data["replicas"] = wc.replicas
+		data["required"] = wc.required
+	}
+	if wc.replicas < wc.required {
+		res["status"] = common.WriteConcernFail
+		res["message"] = fmt.Sprintf("文件已保存，副本数不足 %d/%d", wc.replicas, wc.required)
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+//waitReplicas 按写入级别同步文件 返回确认的副本数 包括已保存文件的storage
+func (t *Tracker) waitReplicas(c *gin.Context, infos map[*StorageServer]model.SyncFileInfo) int {
+	v, _ := c.Get(ctxWriteConcern)
+	wc, _ := v.(*writeConcern)
+	if wc == nil || wc.level == common.WriteConcernOne {
+		for server, info := range infos {
+			go t.SyncFile(server, info)
+		}
+		if wc != nil {
+			wc.replicas, wc.required = 1, 1
+		}
+		return 1
+	}
+
+	//按已保存文件的storage与可同步的storage计算 离线、维护中等storage的副本由同步队列之后补齐
+	replicable := 1
+	for server := range infos {
+		if server.Replicable() {
+			replicable++
+		}
+	}
+	wc.required = wc.requiredReplicas(replicable)
+	wc.replicas = 1
+	results := make(chan bool, len(infos))
+	for server, info := range infos {
+		go func(server *StorageServer, info model.SyncFileInfo) {
+			results <- t.SyncFile(server, info)
+		}(server, info)
+	}
+	timeout := time.NewTimer(writeTimeout())
+	defer timeout.Stop()
+	for pending := len(infos); pending > 0 && wc.replicas < wc.required; pending-- {
+		select {
+		case ok := <-results:
+			if ok {
+				wc.replicas++
+			}
+		case <-timeout.C:
+			return wc.replicas
+		}
+	}
+	return wc.replicas
+}
+
+func writeTimeout() time.Duration {
+	if t := config().Tracker.WriteTimeout; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+	return common.DefaultWriteTimeout * time.Second
+}
+
+//bufferedWriter 缓存响应 等待副本确认后再写回客户端
+type bufferedWriter struct {
+	gin.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *bufferedWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.status != 0
+}
+
+func (w *bufferedWriter) Flush() {}
@@ -0,0 +1,104 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredReplicas(t *testing.T) {
+	cases := []struct {
+		level string
+		n     int
+		want  int
+	}{
+		{common.WriteConcernOne, 3, 1},
+		{common.WriteConcernQuorum, 0, 1},
+		{common.WriteConcernQuorum, 1, 1},
+		{common.WriteConcernQuorum, 2, 2},
+		{common.WriteConcernQuorum, 3, 2},
+		{common.WriteConcernQuorum, 4, 3},
+		{common.WriteConcernAll, 0, 1},
+		{common.WriteConcernAll, 3, 3},
+	}
+	for _, tc := range cases {
+		wc := &writeConcern{level: tc.level}
+		if got := wc.requiredReplicas(tc.n); got != tc.want {
+			t.Errorf("%s requiredReplicas(%d) = %d, want %d", tc.level, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestWriteConcernFinish(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		name     string
+		level    string
+		replicas int
+		required int
+		status   int //空body或非json响应时为0
+		body     string
+	}{
+		{"one not buffered", common.WriteConcernOne, 1, 1, common.Success, ""},
+		{"quorum reached", common.WriteConcernQuorum, 2, 2, common.Success, ""},
+		{"all not reached", common.WriteConcernAll, 2, 3, common.WriteConcernFail, ""},
+		{"upload failed", common.WriteConcernAll, 0, 3, common.Fail, ""},
+		{"not json", common.WriteConcernAll, 1, 3, 0, "bad gateway"},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/upload", nil)
+		c.Request.Header.Set(common.HeaderWriteConcern, tc.level)
+		wc := (&Tracker{}).beginWriteConcern(c)
+		if wc == nil {
+			t.Fatalf("%s: write concern rejected", tc.name)
+		}
+		if tc.level == common.WriteConcernOne && wc.buf != nil {
+			t.Errorf("%s: response buffered", tc.name)
+		}
+		//storage的响应 上传失败时没有副本
+		status := common.Success
+		if tc.replicas == 0 {
+			status = common.Fail
+		}
+		if tc.body != "" {
+			c.String(http.StatusBadGateway, tc.body)
+		} else {
+			c.JSON(http.StatusOK, model.RespResult{Status: status, Data: map[string]interface{}{"url": "g1/a.txt"}})
+		}
+		//finish之前缓存的响应不写回客户端
+		if wc.buf != nil && w.Body.Len() > 0 {
+			t.Errorf("%s: response written before finish", tc.name)
+		}
+		wc.replicas, wc.required = tc.replicas, tc.required
+		wc.finish(c)
+
+		if tc.body != "" {
+			if w.Code != http.StatusBadGateway || w.Body.String() != tc.body {
+				t.Errorf("%s: got %d %q", tc.name, w.Code, w.Body.String())
+			}
+			continue
+		}
+		var res struct {
+			Status int                    `json:"status"`
+			Data   map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res.Status != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, res.Status, tc.status)
+		}
+		_, ok := res.Data["replicas"]
+		if rewrite := tc.level != common.WriteConcernOne && tc.replicas > 0; ok != rewrite {
+			t.Errorf("%s: replicas in body %v, want %v", tc.name, ok, rewrite)
+		} else if ok && (int(res.Data["replicas"].(float64)) != tc.replicas || int(res.Data["required"].(float64)) != tc.required) {
+			t.Errorf("%s: data %v", tc.name, res.Data)
+		}
+	}
+}
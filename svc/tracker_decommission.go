@@ -0,0 +1,597 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//storage与group下线
+//下线storage时检查其文件目录中的每个文件在group内其他storage上的副本，不足时从该storage同步补齐；
+//下线group时将文件迁移到目标group。任务进度保存在共享的decommission库中，leader定时继续执行未完成的任务，
+//复制阶段所有文件满足副本数后进入校验阶段，校验通过后才从group中移除storage，已下线的storage再次上报状态时被拒绝
+
+const (
+	decommissionDBName = "decommission"
+	retiredDBName      = "retired"
+)
+
+//getDecommission 获取下线任务
+func (t *Tracker) getDecommission(id string) (*model.Decommission, error) {
+	data, err := t.decommissionDB.Get(id)
+	if err != nil {
+		return nil, errors.New("no such decommission")
+	}
+	var d model.Decommission
+	if err = json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (t *Tracker) putDecommission(d *model.Decommission) error {
+	d.UpdateTime = time.Now().Unix()
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return t.decommissionDB.Put(d.Id, data)
+}
+
+//listDecommissions 所有下线任务 按创建时间排序
+func (t *Tracker) listDecommissions() []*model.Decommission {
+	list := make([]*model.Decommission, 0)
+	_ = t.decommissionDB.Range("", func(key, value []byte) bool {
+		var d model.Decommission
+		if err := json.Unmarshal(value, &d); err == nil {
+			list = append(list, &d)
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreateTime < list[j].CreateTime
+	})
+	return list
+}
+
+//isRetired storage是否已下线 整个group下线时记录为{group}@
+func (t *Tracker) isRetired(group, addr string) bool {
+	if _, err := t.retiredDB.Get(storageRecordKey(group, addr)); err == nil {
+		return true
+	}
+	_, err := t.retiredDB.Get(storageRecordKey(group, ""))
+	return err == nil
+}
+
+//retire 记录已完成的下线任务下线的storage
+func (t *Tracker) retire(d *model.Decommission) error {
+	return t.retiredDB.Put(storageRecordKey(d.Group, d.Addr), []byte(d.Id))
+}
+
+//unretire 删除下线任务的下线记录 之后storage可以重新注册
+func (t *Tracker) unretire(d *model.Decommission) error {
+	key := storageRecordKey(d.Group, d.Addr)
+	if id, err := t.retiredDB.Get(key); err != nil || string(id) != d.Id {
+		return nil
+	}
+	return t.retiredDB.Delete(key)
+}
+
+//decommissionActive 任务是否未结束
+func decommissionActive(d *model.Decommission) bool {
+	return d.State == common.DecommissionRunning || d.State == common.DecommissionVerifying || d.State == common.DecommissionFailed
+}
+
+//decommissionStorages 任务下线的storage
+func decommissionStorages(d *model.Decommission, g *Group) []*StorageServer {
+	if d.Addr != "" {
+		if s := g.GetStorage(d.Addr); s != nil {
+			return []*StorageServer{s}
+		}
+		return nil
+	}
+	return g.GetStorages()
+}
+
+//setDecommissionState 设置下线storage的运维状态 state为0时只取消排空状态
+func (t *Tracker) setDecommissionState(d *model.Decommission, state int) error {
+	g := t.GetGroup(d.Group)
+	if g == nil {
+		return nil
+	}
+	for _, s := range decommissionStorages(d, g) {
+		attr := s.Attr
+		if state == 0 && attr.State != common.StorageDraining {
+			continue
+		}
+		attr.State = state
+		cmd := &Command{Op: cmdStorageAttr, Storage: &StorageServer{Group: s.Group, Addr: s.Addr, Attr: attr}}
+		if err := t.cluster.Apply(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//applyStorageRemove 从group中移除storage addr为空时移除整个group
+func (t *Tracker) applyStorageRemove(sm *StorageServer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	group := t.GetGroup(sm.Group)
+	if group == nil {
+		return nil
+	}
+	for _, s := range group.GetStorages() {
+		if sm.Addr != "" && s.Addr != sm.Addr {
+			continue
+		}
+		_ = group.RemoveStorage(s)
+		_ = t.groupDB.Delete(storageRecordKey(s.Group, s.Addr))
+		logger.Info("storage removed", zap.String("group", s.Group), zap.String("addr", s.Addr))
+	}
+	if len(group.GetStorages()) == 0 {
+		t.mu.Lock()
+		delete(t.groups, group.Name)
+		t.mu.Unlock()
+	}
+	t.SetTrackerStatus()
+	return nil
+}
+
+//RunDecommissions 继续执行未完成的下线任务 只由leader执行
+func (t *Tracker) RunDecommissions() {
+	if !t.cluster.IsLeader() {
+		return
+	}
+	for _, d := range t.listDecommissions() {
+		switch d.State {
+		case common.DecommissionRunning, common.DecommissionVerifying:
+			t.runDecommission(d)
+		case common.DecommissionDone:
+			//记录下线或移除storage前中断的任务
+			if _, err := t.retiredDB.Get(storageRecordKey(d.Group, d.Addr)); err != nil {
+				if err = t.retire(d); err != nil {
+					continue
+				}
+			}
+			if g := t.GetGroup(d.Group); g != nil && len(decommissionStorages(d, g)) > 0 {
+				_ = t.cluster.Apply(&Command{Op: cmdStorageRemove, Storage: &StorageServer{Group: d.Group, Addr: d.Addr}})
+			}
+		}
+	}
+}
+
+//runDecommission 从上次的位置继续执行一轮复制或校验
+func (t *Tracker) runDecommission(d *model.Decommission) {
+	verify := d.State == common.DecommissionVerifying
+	g := t.GetGroup(d.Group)
+	if g == nil {
+		d.State, d.LastError = common.DecommissionFailed, "no such group"
+		_ = t.putDecommission(d)
+		return
+	}
+	sources := make([]string, 0)
+	for _, s := range decommissionStorages(d, g) {
+		sources = append(sources, s.Addr)
+	}
+	for _, addr := range sources {
+		if addr < d.Source {
+			continue
+		}
+		if addr != d.Source {
+			d.Source, d.Cursor = addr, ""
+		}
+		src := g.GetStorage(addr)
+		if src == nil || !src.Servable() {
+			d.LastError = "source storage unavailable: " + addr
+			_ = t.putDecommission(d)
+			return
+		}
+		for {
+			//leader切换或任务被取消时停止
+			if cur, err := t.getDecommission(d.Id); err != nil || cur.State != d.State || !t.cluster.IsLeader() {
+				return
+			}
+			page, err := t.fetchStorageCatalog(src, d.Cursor)
+			if err != nil {
+				d.LastError = err.Error()
+				_ = t.putDecommission(d)
+				return
+			}
+			if len(page.Files) == 0 {
+				break
+			}
+			d.Total = page.Total
+			for _, entry := range page.Files {
+				ok, copied := t.evacuateFile(d, src, entry, verify)
+				d.Checked++
+				d.Copied += copied
+				if !ok {
+					d.Missing++
+				}
+				d.Cursor = entry.Md5
+			}
+			if err = t.putDecommission(d); err != nil {
+				return
+			}
+		}
+	}
+	t.finishDecommissionPass(d, verify)
+}
+
+//finishDecommissionPass 一轮结束 全部满足副本数时进入下一阶段，否则重新复制
+func (t *Tracker) finishDecommissionPass(d *model.Decommission, verify bool) {
+	missing := d.Missing
+	d.Source, d.Cursor, d.Checked, d.Missing = "", "", 0, 0
+	switch {
+	case missing == 0 && verify:
+		d.State, d.LastError = common.DecommissionDone, ""
+		if err := t.putDecommission(d); err != nil {
+			return
+		}
+		if err := t.retire(d); err != nil {
+			logger.Error("decommission retire fail", zap.String("id", d.Id), zap.Error(err))
+			return
+		}
+		if err := t.cluster.Apply(&Command{Op: cmdStorageRemove, Storage: &StorageServer{Group: d.Group, Addr: d.Addr}}); err != nil {
+			logger.Error("decommission remove storage fail", zap.String("id", d.Id), zap.Error(err))
+		}
+		logger.Info("decommission done", zap.String("group", d.Group), zap.String("addr", d.Addr))
+	case missing == 0:
+		d.State, d.LastError = common.DecommissionVerifying, ""
+		_ = t.putDecommission(d)
+	default:
+		d.State = common.DecommissionRunning
+		if !verify {
+			d.Pass++
+		}
+		d.LastError = fmt.Sprintf("%d files lack replicas", missing)
+		if d.Pass >= common.DefaultDecommissionPasses {
+			d.State = common.DecommissionFailed
+		}
+		_ = t.putDecommission(d)
+	}
+}
+
+//evacuateFile 检查文件在其他storage上的副本 复制阶段从src同步补齐 返回是否满足副本数以及同步的引用数
+func (t *Tracker) evacuateFile(d *model.Decommission, src *StorageServer, entry model.CatalogEntry, verify bool) (bool, int64) {
+	dstName := d.Group
+	if d.Target != "" {
+		dstName = d.Target
+	}
+	dst := t.GetGroup(dstName)
+	if dst == nil {
+		return false, 0
+	}
+	refs := entry.Refs
+	if len(refs) == 0 {
+		refs = []model.FileRef{{FileId: entry.FileId}}
+	}
+
+	type candidate struct {
+		s       *StorageServer
+		missing []model.FileRef
+	}
+	satisfied := 0
+	var holder *StorageServer
+	candidates := make([]candidate, 0)
+	for _, p := range dst.GetStorages() {
+		if (d.Target == "" && p.Addr == d.Addr) || !p.Servable() {
+			continue
+		}
+		missing, err := t.missingRefs(p, entry.Md5, refs)
+		if err != nil {
+			continue
+		}
+		if len(missing) == 0 {
+			satisfied++
+			holder = p
+		} else if p.Replicable() {
+			candidates = append(candidates, candidate{s: p, missing: missing})
+		}
+	}
+	if verify {
+		if satisfied < d.Replicas {
+			return false, 0
+		}
+		//group下线后原地址与文件id跳转到目标group 记录失败时不移除group
+		if d.Target != "" {
+			if err := t.redirectEvacuated(d, holder, entry.Path, refs); err != nil {
+				logger.Warn("decommission redirect fail", zap.String("id", d.Id), zap.String("path", entry.Path), zap.Error(err))
+				return false, 0
+			}
+		}
+		return true, 0
+	}
+
+	var copied int64
+	for _, c := range candidates {
+		if satisfied >= d.Replicas {
+			break
+		}
+		ok := true
+		for _, ref := range c.missing {
+			info := model.SyncFileInfo{
+				Src:      src.HttpSchema + "://" + src.Addr,
+				Dst:      c.s.HttpSchema + "://" + c.s.Addr,
+				FileId:   ref.FileId,
+				FilePath: path.Dir(entry.Path),
+				FileName: path.Base(entry.Path),
+				FileHash: entry.Md5,
+				Action:   common.SyncAdd,
+				Group:    dst.Name,
+			}
+			if d.Target != "" {
+				info.SrcGroup = d.Group
+			}
+			if ok = t.SyncFile(c.s, info); !ok {
+				break
+			}
+			copied++
+		}
+		if ok {
+			satisfied++
+		}
+	}
+	return satisfied >= d.Replicas, copied
+}
+
+//redirectEvacuated 记录下线group中的文件在目标group中的位置 与跨group迁移使用相同的跳转记录
+func (t *Tracker) redirectEvacuated(d *model.Decommission, holder *StorageServer, file string, refs []model.FileRef) error {
+	//目标storage上已有相同文件时引用指向已有的路径
+	fi, err := t.getStorageFileInfo(holder, refs[0].FileId)
+	if err != nil {
+		return err
+	}
+	target := strings.TrimPrefix(fi.Path, "/")
+	//文件曾从目标group迁出时删除旧的跳转 避免循环跳转
+	if _, err = t.redirectDB.Get(redirectPathKey(d.Target, target)); err == nil {
+		if err = t.redirectDB.Delete(redirectPathKey(d.Target, target)); err != nil {
+			return err
+		}
+	}
+	data, _ := json.Marshal(model.FileRedirect{Group: d.Target, Path: target})
+	if err = t.redirectDB.Put(redirectPathKey(d.Group, file), data); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err = t.redirectDB.Put(redirectIdKey(ref.FileId), []byte(d.Target)); err != nil {
+			return err
+		}
+		t.fileGroups.Store(ref.FileId, d.Target)
+	}
+	return nil
+}
+
+//missingRefs storage上缺少的文件引用 没有该文件时返回所有引用
+func (t *Tracker) missingRefs(s *StorageServer, md5 string, refs []model.FileRef) ([]model.FileRef, error) {
+	resp, err := util.HttpGet(s.HttpSchema+"://"+s.Addr+"/refs/"+md5, nil, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Status int               `json:"status"`
+		Data   model.FileRefInfo `json:"data"`
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Status == common.FileNotFound {
+		return refs, nil
+	}
+	if res.Status != common.Success {
+		return nil, errors.New("refs fail: status " + strconv.Itoa(res.Status))
+	}
+	exist := make(map[string]bool)
+	for _, ref := range res.Data.Refs {
+		exist[ref.FileId] = true
+	}
+	missing := make([]model.FileRef, 0)
+	for _, ref := range refs {
+		if !exist[ref.FileId] {
+			missing = append(missing, ref)
+		}
+	}
+	return missing, nil
+}
+
+//fetchStorageCatalog 获取storage的一页文件目录
+func (t *Tracker) fetchStorageCatalog(s *StorageServer, after string) (*model.CatalogPage, error) {
+	q := url.Values{"after": {after}, "limit": {strconv.Itoa(catalogPageSize)}}
+	resp, err := util.HttpGet(s.HttpSchema+"://"+s.Addr+"/catalog?"+q.Encode(), nil, time.Second*30)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Status int               `json:"status"`
+		Data   model.CatalogPage `json:"data"`
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != common.Success {
+		return nil, errors.New("catalog fail: status " + strconv.Itoa(res.Status))
+	}
+	return &res.Data, nil
+}
+
+//StartDecommission api 创建下线任务
+//指定addr时下线该storage，否则下线整个group并迁移到target，replicas为其他storage上需要的副本数 默认1
+func (t *Tracker) StartDecommission(c *gin.Context) {
+	var params struct {
+		Group    string `json:"group" form:"group" binding:"required"`
+		Addr     string `json:"addr" form:"addr"`
+		Target   string `json:"target" form:"target"`
+		Replicas int    `json:"replicas" form:"replicas"`
+	}
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if params.Replicas <= 0 {
+		params.Replicas = 1
+	}
+	d := &model.Decommission{
+		Id:         util.GenFileUUID(),
+		Group:      params.Group,
+		Addr:       params.Addr,
+		Replicas:   params.Replicas,
+		State:      common.DecommissionRunning,
+		CreateTime: time.Now().Unix(),
+	}
+	if params.Addr == "" {
+		d.Target = params.Target
+	}
+	if err := t.checkDecommission(d); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	if err := t.putDecommission(d); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	//下线期间不再接受新的上传
+	if err := t.setDecommissionState(d, common.StorageDraining); err != nil {
+		logger.Warn("decommission drain fail", zap.String("id", d.Id), zap.Error(err))
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   d,
+	})
+}
+
+//checkDecommission 检查下线任务参数以及剩余storage是否足够
+func (t *Tracker) checkDecommission(d *model.Decommission) error {
+	g := t.GetGroup(d.Group)
+	if g == nil {
+		return errors.New("no such group")
+	}
+	for _, other := range t.listDecommissions() {
+		if decommissionActive(other) && other.Group == d.Group && (other.Addr == "" || d.Addr == "" || other.Addr == d.Addr) {
+			return errors.New("decommission already exists: " + other.Id)
+		}
+	}
+	remain := 0
+	if d.Addr != "" {
+		if g.GetStorage(d.Addr) == nil {
+			return errors.New("no such storage")
+		}
+		for _, s := range g.GetStorages() {
+			if s.Addr != d.Addr && s.Replicable() {
+				remain++
+			}
+		}
+	} else {
+		if d.Target == "" || d.Target == d.Group {
+			return errors.New("target group required")
+		}
+		target := t.GetGroup(d.Target)
+		if target == nil {
+			return errors.New("no such target group")
+		}
+		for _, s := range target.GetStorages() {
+			if s.Replicable() {
+				remain++
+			}
+		}
+	}
+	if remain < d.Replicas {
+		return fmt.Errorf("not enough storages for %d replicas: %d available", d.Replicas, remain)
+	}
+	return nil
+}
+
+//Decommissions api 下线任务 指定id时返回该任务
+func (t *Tracker) Decommissions(c *gin.Context) {
+	if id := c.Query("id"); id != "" {
+		d, err := t.getDecommission(id)
+		if err != nil {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: d})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   t.listDecommissions(),
+	})
+}
+
+//ResumeDecommission api 继续执行失败的下线任务
+func (t *Tracker) ResumeDecommission(c *gin.Context) {
+	d, ok := t.bindDecommission(c)
+	if !ok {
+		return
+	}
+	if d.State != common.DecommissionFailed {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "decommission not failed"})
+		return
+	}
+	d.State, d.Pass = common.DecommissionRunning, 0
+	if err := t.putDecommission(d); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: d})
+}
+
+//CancelDecommission api 取消未完成的下线任务并恢复storage 已完成的任务删除后storage可以重新注册
+func (t *Tracker) CancelDecommission(c *gin.Context) {
+	d, ok := t.bindDecommission(c)
+	if !ok {
+		return
+	}
+	var err error
+	switch d.State {
+	case common.DecommissionDone, common.DecommissionCanceled:
+		if err = t.unretire(d); err == nil {
+			err = t.decommissionDB.Delete(d.Id)
+		}
+	default:
+		d.State = common.DecommissionCanceled
+		if err = t.putDecommission(d); err == nil {
+			err = t.setDecommissionState(d, 0)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: d})
+}
+
+func (t *Tracker) bindDecommission(c *gin.Context) (*model.Decommission, bool) {
+	var params struct {
+		Id string `json:"id" form:"id" binding:"required"`
+	}
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return nil, false
+	}
+	d, err := t.getDecommission(params.Id)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return nil, false
+	}
+	return d, true
+}
@@ -0,0 +1,176 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errNoSuchFile = errors.New("no such file")
+
+//FileInfo api file id获取文件信息
+func (t *Tracker) FileInfo(c *gin.Context) {
+	_, _, fi, err := t.locateFile(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileNotFound,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   fi,
+	})
+}
+
+//FileContent api file id下载文件
+func (t *Tracker) FileContent(c *gin.Context) {
+	group, s, fi, err := t.locateFile(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileNotFound,
+			Message: err.Error(),
+		})
+		return
+	}
+	if config().Tracker.DownloadMode == common.DownloadModeRedirect {
+		t.redirectDownload(c, s, fi.Path)
+		return
+	}
+	if token := t.signDownload(group.Name, fi.Path); token != nil {
+		c.Request.URL.RawQuery = token.Encode()
+	}
+	if _, err = t.httpProxyFailover(c, group, s, (*StorageServer).Servable); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+	}
+}
+
+//FileRefs api 文件引用数
+func (t *Tracker) FileRefs(c *gin.Context) {
+	group := t.GetGroup(c.Query("group"))
+	if group == nil || group.Status != common.GroupActive {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no available group"})
+		return
+	}
+	s, err := t.SelectStorageForDownload(c.ClientIP(), group)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	if _, err = t.httpProxyFailover(c, group, s, (*StorageServer).Servable); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+	}
+}
+
+//locateFile 查找file id所在的group以及保存该文件的storage
+//优先查询迁移后以及上传时记录的group，未命中时依次查询所有可用group
+func (t *Tracker) locateFile(fileId string) (*Group, *StorageServer, *model.FileInfo, error) {
+	if fileId == "" {
+		return nil, nil, nil, errors.New("file id can not be nil")
+	}
+	groups := make([]*Group, 0)
+	if name := t.redirectGroup(fileId); name != "" {
+		if g := t.GetGroup(name); g != nil {
+			groups = append(groups, g)
+		}
+	}
+	if name, ok := t.fileGroups.Load(fileId); ok {
+		if g := t.GetGroup(name.(string)); g != nil {
+			groups = append(groups, g)
+		}
+	}
+	groups = append(groups, t.GetGroups()...)
+
+	searched := make(map[string]bool)
+	for _, g := range groups {
+		if searched[g.Name] || g.Status != common.GroupActive {
+			continue
+		}
+		searched[g.Name] = true
+		for _, s := range g.GetStorages() {
+			if !s.Servable() {
+				continue
+			}
+			fi, err := t.getStorageFileInfo(s, fileId)
+			if err != nil {
+				continue
+			}
+			t.fileGroups.Store(fileId, g.Name)
+			return g, s, fi, nil
+		}
+	}
+	t.fileGroups.Delete(fileId)
+	return nil, nil, nil, errNoSuchFile
+}
+
+//getStorageFileInfo 向storage查询file id对应的文件信息
+func (t *Tracker) getStorageFileInfo(s *StorageServer, fileId string) (*model.FileInfo, error) {
+	url := s.HttpSchema + "://" + s.Addr + "/file/" + fileId
+	resp, err := util.HttpGet(url, nil, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Status int            `json:"status"`
+		Data   model.FileInfo `json:"data"`
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != common.Success {
+		return nil, errNoSuchFile
+	}
+	return &res.Data, nil
+}
+
+//fileExists 检查group中是否存在文件 指定file id时同时校验路径 没有可查询的storage时返回错误
+func (t *Tracker) fileExists(g *Group, fileId, file string) (bool, error) {
+	file = strings.TrimPrefix(file, "/")
+	checked := false
+	for _, s := range g.GetStorages() {
+		if !s.Servable() {
+			continue
+		}
+		if fileId != "" {
+			fi, err := t.getStorageFileInfo(s, fileId)
+			if err == nil {
+				return strings.TrimPrefix(fi.Path, "/") == file, nil
+			}
+			if err == errNoSuchFile {
+				checked = true
+			}
+			continue
+		}
+		target := fileStaticUrl(s.HttpSchema, s.Addr, g.Name, (&url.URL{Path: file}).EscapedPath())
+		if token := t.signDownload(g.Name, file); token != nil {
+			target += "?" + token.Encode()
+		}
+		resp, err := util.NodeClient(time.Second * 5).Head(target)
+		if err != nil {
+			continue
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return true, nil
+		}
+		checked = true
+	}
+	if !checked {
+		return false, errors.New("no available storage for group")
+	}
+	return false, nil
+}
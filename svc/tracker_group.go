@@ -0,0 +1,285 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+//group持久化
+//storage的注册信息与运维设置的属性保存在tracker的group库中，key: {group}@{addr}
+//tracker重启后恢复为等待确认状态，收到storage心跳后恢复正常，超过离线判定时间未收到心跳则由leader标记离线
+
+const groupDBName = "group"
+
+//storageStates 运维可设置的storage状态
+var storageStates = map[string]int{
+	"":            0,
+	"maintenance": common.StorageMaintenance,
+	"draining":    common.StorageDraining,
+	"readonly":    common.StorageReadOnly,
+}
+
+func storageRecordKey(group, addr string) string {
+	return group + "@" + addr
+}
+
+//loadGroups 从持久化记录恢复group与storage
+func (t *Tracker) loadGroups() {
+	now := time.Now().Unix()
+	groups := make(map[string]*Group)
+	_ = t.groupDB.Range("", func(key, value []byte) bool {
+		var s StorageServer
+		if err := json.Unmarshal(value, &s); err != nil || s.Addr == "" || s.Group == "" {
+			return true
+		}
+		g, ok := groups[s.Group]
+		if !ok {
+			g = &Group{
+				Name:     s.Group,
+				Status:   common.GroupActive,
+				Storages: make(map[string]*StorageServer),
+			}
+			groups[s.Group] = g
+		}
+		g.Storages[s.Addr] = &s
+		return true
+	})
+	pendingGroups(groups, now)
+	t.mu.Lock()
+	t.groups = groups
+	t.mu.Unlock()
+	if len(groups) > 0 {
+		t.SetTrackerStatus()
+		logger.Info("groups restored, pending heartbeat", zap.Int("groups", len(groups)))
+	}
+}
+
+//pendingGroups 恢复的storage标记为等待确认 运维设置的状态保持不变
+func pendingGroups(groups map[string]*Group, now int64) {
+	for _, g := range groups {
+		for _, s := range g.Storages {
+			s.Status = common.StoragePending
+			if s.Attr.State != 0 {
+				s.Status = s.Attr.State
+			}
+			s.UpdateTime = now
+		}
+	}
+}
+
+//saveStorageRecord 持久化storage的注册信息与属性
+func (t *Tracker) saveStorageRecord(s *StorageServer) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	if err = t.groupDB.Put(storageRecordKey(s.Group, s.Addr), data); err != nil {
+		logger.Error("storage record save fail", zap.String("addr", s.Addr), zap.Error(err))
+	}
+}
+
+//persistGroups 用当前的group替换持久化记录
+func (t *Tracker) persistGroups() {
+	keys := make([]string, 0)
+	_ = t.groupDB.Range("", func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	_ = t.groupDB.Delete(keys...)
+	for _, g := range t.GetGroups() {
+		for _, s := range g.GetStorages() {
+			t.saveStorageRecord(s)
+		}
+	}
+}
+
+//operatorStatus 运维设置的状态覆盖心跳计算的状态
+//离线的storage保持离线，全量同步中的storage只能设置为维护状态
+func operatorStatus(status, state int) int {
+	if state == 0 || status == common.StorageOffline {
+		return status
+	}
+	if status == common.StorageSyncing && state != common.StorageMaintenance {
+		return status
+	}
+	return state
+}
+
+//applyStorageAttr 设置storage属性
+func (t *Tracker) applyStorageAttr(sm *StorageServer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	group := t.GetGroup(sm.Group)
+	if group == nil {
+		return errors.New("no such group")
+	}
+	s := group.GetStorage(sm.Addr)
+	if s == nil {
+		return errors.New("no such storage")
+	}
+	old := s.Attr
+	s.Attr = sm.Attr
+	if s.Attr.State != 0 {
+		s.Status = operatorStatus(s.Status, s.Attr.State)
+	} else if old.State != 0 && s.Status == old.State {
+		//取消运维状态 等待下一次心跳确认
+		s.Status = common.StoragePending
+	}
+	t.saveStorageRecord(s)
+	t.SetTrackerStatus()
+	return nil
+}
+
+//applyStorageStatus 更新storage的状态 状态变化由leader判定
+func (t *Tracker) applyStorageStatus(sm *StorageServer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	group := t.GetGroup(sm.Group)
+	if group == nil {
+		return errors.New("no such group")
+	}
+	s := group.GetStorage(sm.Addr)
+	if s == nil {
+		return errors.New("no such storage")
+	}
+	s.Status = operatorStatus(sm.Status, s.Attr.State)
+	t.SetTrackerStatus()
+	return nil
+}
+
+//setStorageStatus 提交storage的状态变化
+func (t *Tracker) setStorageStatus(s *StorageServer, status int) {
+	cmd := &Command{Op: cmdStorageStatus, Storage: &StorageServer{Group: s.Group, Addr: s.Addr, Status: status}}
+	if err := t.cluster.Apply(cmd); err != nil {
+		logger.Warn("storage status apply fail", zap.String("addr", s.Addr), zap.Int("status", status), zap.Error(err))
+	}
+}
+
+//StorageAttr api 设置storage的权重与运维状态 state: maintenance||draining||readonly 为空时取消
+func (t *Tracker) StorageAttr(c *gin.Context) {
+	var params struct {
+		Group  string  `json:"group" form:"group" binding:"required"`
+		Addr   string  `json:"addr" form:"addr" binding:"required"`
+		Weight *int    `json:"weight" form:"weight"`
+		State  *string `json:"state" form:"state"`
+	}
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if params.Weight != nil && *params.Weight < 0 {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: "weight must not be negative"})
+		return
+	}
+	state := 0
+	if params.State != nil {
+		var ok bool
+		if state, ok = storageStates[*params.State]; !ok {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: "invalid state: " + *params.State})
+			return
+		}
+	}
+	t.updateStorageAttr(c, params.Group, params.Addr, func(attr *StorageAttr) {
+		if params.Weight != nil {
+			attr.Weight = *params.Weight
+		}
+		if params.State != nil {
+			attr.State = state
+		}
+	})
+}
+
+//StorageState api 设置storage的运维状态 state为空时恢复正常
+func (t *Tracker) StorageState(state string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params struct {
+			Group string `json:"group" form:"group" binding:"required"`
+			Addr  string `json:"addr" form:"addr" binding:"required"`
+		}
+		if err := c.ShouldBind(&params); err != nil {
+			c.JSON(http.StatusOK, model.RespResult{
+				Status:  common.ParamBindFail,
+				Message: err.Error(),
+			})
+			return
+		}
+		t.updateStorageAttr(c, params.Group, params.Addr, func(attr *StorageAttr) {
+			attr.State = storageStates[state]
+		})
+	}
+}
+
+//updateStorageAttr 修改storage属性并提交 返回修改后的storage
+func (t *Tracker) updateStorageAttr(c *gin.Context, groupName, addr string, fn func(attr *StorageAttr)) {
+	group := t.GetGroup(groupName)
+	if group == nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no such group"})
+		return
+	}
+	s := group.GetStorage(addr)
+	if s == nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no such storage"})
+		return
+	}
+	attr := s.Attr
+	fn(&attr)
+	cmd := &Command{Op: cmdStorageAttr, Storage: &StorageServer{Group: s.Group, Addr: s.Addr, Attr: attr}}
+	if err := t.cluster.Apply(cmd); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   group.GetStorage(addr),
+	})
+}
+
+//DrainInfo storage排空进度
+type DrainInfo struct {
+	Status   int   `json:"status"`
+	InFlight int64 `json:"in_flight"` //经tracker代理中的请求数
+	Uploads  int   `json:"uploads"`   //未完成的上传会话数
+	Drained  bool  `json:"drained"`
+}
+
+//DrainStatus api 排空进度 drained为true时已没有经tracker代理的请求以及未完成的上传会话，可以停止storage
+func (t *Tracker) DrainStatus(c *gin.Context) {
+	group := t.GetGroup(c.Query("group"))
+	if group == nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no such group"})
+		return
+	}
+	s := group.GetStorage(c.Query("addr"))
+	if s == nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "no such storage"})
+		return
+	}
+	uploads := 0
+	_ = t.uploadDB.Range("", func(key, value []byte) bool {
+		var route model.UploadRoute
+		if err := json.Unmarshal(value, &route); err == nil && route.Group == s.Group && route.Addr == s.Addr {
+			uploads++
+		}
+		return true
+	})
+	inFlight := t.InFlight(s.Addr)
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data: DrainInfo{
+			Status:   s.Status,
+			InFlight: inFlight,
+			Uploads:  uploads,
+			Drained:  s.Attr.State == common.StorageDraining && inFlight == 0 && uploads == 0,
+		},
+	})
+}
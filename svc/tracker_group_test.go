@@ -0,0 +1,80 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"fmt"
+	"testing"
+)
+
+func TestOperatorStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		state  int
+		want   int
+	}{
+		{common.StorageActive, 0, common.StorageActive},
+		{common.StorageActive, common.StorageMaintenance, common.StorageMaintenance},
+		{common.StorageActive, common.StorageDraining, common.StorageDraining},
+		{common.StorageActive, common.StorageReadOnly, common.StorageReadOnly},
+		{common.StoragePending, common.StorageDraining, common.StorageDraining},
+		{common.StorageNotEnoughSpace, common.StorageReadOnly, common.StorageReadOnly},
+		//离线的storage保持离线
+		{common.StorageOffline, common.StorageMaintenance, common.StorageOffline},
+		{common.StorageOffline, common.StorageDraining, common.StorageOffline},
+		//全量同步中只能设置为维护状态
+		{common.StorageSyncing, common.StorageDraining, common.StorageSyncing},
+		{common.StorageSyncing, common.StorageReadOnly, common.StorageSyncing},
+		{common.StorageSyncing, common.StorageMaintenance, common.StorageMaintenance},
+	}
+	for _, tc := range cases {
+		if got := operatorStatus(tc.status, tc.state); got != tc.want {
+			t.Errorf("operatorStatus(%d, %d) = %d, want %d", tc.status, tc.state, got, tc.want)
+		}
+	}
+}
+
+func TestStorageStatus(t *testing.T) {
+	cases := []struct {
+		status     int
+		writable   bool
+		servable   bool
+		replicable bool
+	}{
+		{common.StorageOffline, false, false, false},
+		{common.StorageActive, true, true, true},
+		{common.StorageNotEnoughSpace, false, false, false},
+		{common.StorageSyncing, false, false, false},
+		{common.StoragePending, true, true, false},
+		{common.StorageMaintenance, false, false, false},
+		{common.StorageDraining, false, true, true},
+		{common.StorageReadOnly, false, true, false},
+	}
+	for _, tc := range cases {
+		s := &StorageServer{Status: tc.status}
+		if s.Writable() != tc.writable || s.Servable() != tc.servable || s.Replicable() != tc.replicable {
+			t.Errorf("status %d: writable %v servable %v replicable %v", tc.status, s.Writable(), s.Servable(), s.Replicable())
+		}
+	}
+}
+
+func TestGroupWritable(t *testing.T) {
+	cases := []struct {
+		statuses []int
+		want     bool
+	}{
+		{nil, false},
+		{[]int{common.StorageDraining, common.StorageReadOnly}, false},
+		{[]int{common.StorageOffline, common.StoragePending}, true},
+		{[]int{common.StorageMaintenance, common.StorageActive}, true},
+	}
+	for _, tc := range cases {
+		g := &Group{Name: "g1", Storages: make(map[string]*StorageServer)}
+		for i, status := range tc.statuses {
+			addr := fmt.Sprintf("10.0.0.%d:8080", i+1)
+			g.Storages[addr] = &StorageServer{Group: "g1", Addr: addr, Status: status}
+		}
+		if got := g.Writable(); got != tc.want {
+			t.Errorf("%v: writable %v, want %v", tc.statuses, got, tc.want)
+		}
+	}
+}
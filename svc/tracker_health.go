@@ -0,0 +1,271 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//主动健康检查
+//tracker定时请求每个storage的/health，连续失败health_fall次标记离线，连续成功health_rise次后恢复为等待心跳确认，
+//标记离线期间忽略该storage的心跳。
+//每个tracker独立检查，检查状态记录在内存中，storage状态的变化只由leader提交
+
+//storageExpire 超过该时间没有收到心跳的storage标记离线 单位秒
+const storageExpire = 5 * 10
+
+//ExpireStorages 超过storageExpire没有收到心跳的storage提交离线 只由leader执行
+func (t *Tracker) ExpireStorages() {
+	if !t.cluster.IsLeader() {
+		return
+	}
+	now := time.Now().Unix()
+	for _, g := range t.GetGroups() {
+		for _, s := range g.GetStorages() {
+			//运维设置的维护状态不受心跳影响
+			if s.Status == common.StorageOffline || s.Status == common.StorageMaintenance || now-s.UpdateTime <= storageExpire {
+				continue
+			}
+			logger.Warn("storage heartbeat expired", zap.String("group", s.Group), zap.String("addr", s.Addr))
+			t.setStorageStatus(s, common.StorageOffline)
+		}
+	}
+}
+
+//healthHistorySize 保留的状态变化记录数
+const healthHistorySize = 200
+
+//HealthState storage的检查状态
+type HealthState struct {
+	Group     string `json:"group"`
+	Addr      string `json:"addr"`
+	Up        bool   `json:"up"`
+	Successes int    `json:"successes"` //连续成功次数
+	Failures  int    `json:"failures"`  //连续失败次数
+	Latency   int64  `json:"latency"`   //最近一次检查耗时 单位毫秒
+	LastError string `json:"last_error,omitempty"`
+	LastCheck int64  `json:"last_check"`
+}
+
+//HealthTransition storage的上线或离线记录
+type HealthTransition struct {
+	Group  string `json:"group"`
+	Addr   string `json:"addr"`
+	Up     bool   `json:"up"`
+	Reason string `json:"reason,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+//HealthInfo 健康检查状态与状态变化记录 记录按时间倒序
+type HealthInfo struct {
+	Storages []HealthState      `json:"storages"`
+	History  []HealthTransition `json:"history"`
+}
+
+type healthChecker struct {
+	mu      sync.Mutex
+	states  map[string]*HealthState //{group}@{addr} -> state
+	history []HealthTransition
+}
+
+//healthSpec 健康检查的cron表达式 关闭时返回空
+func healthSpec() string {
+	interval := config().Tracker.HealthInterval
+	if interval < 0 {
+		return ""
+	}
+	if interval == 0 {
+		interval = common.DefaultHealthInterval
+	}
+	return "@every " + (time.Duration(interval) * time.Second).String()
+}
+
+func healthThreshold(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+//ProbeStorages 检查所有storage 维护中的storage不检查
+func (t *Tracker) ProbeStorages() {
+	storages := make([]*StorageServer, 0)
+	for _, g := range t.GetGroups() {
+		for _, s := range g.GetStorages() {
+			if s.Status != common.StorageMaintenance {
+				storages = append(storages, s)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for _, s := range storages {
+		wg.Add(1)
+		go func(s *StorageServer) {
+			defer wg.Done()
+			start := time.Now()
+			err := t.probeStorage(s)
+			t.recordProbe(s, time.Since(start), err)
+		}(s)
+	}
+	wg.Wait()
+	t.cleanHealthStates()
+}
+
+//probeStorage 请求storage的/health
+func (t *Tracker) probeStorage(s *StorageServer) error {
+	timeout := config().Tracker.HealthTimeout
+	if timeout <= 0 {
+		timeout = common.DefaultHealthTimeout
+	}
+	resp, err := util.HttpGet(s.HttpSchema+"://"+s.Addr+"/health", nil, time.Duration(timeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	var res model.RespResult
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return err
+	}
+	if res.Status != common.Success {
+		return errors.New("health fail: status " + strconv.Itoa(res.Status) + " " + res.Message)
+	}
+	return nil
+}
+
+//recordProbe 记录检查结果 达到阈值时切换storage状态
+func (t *Tracker) recordProbe(s *StorageServer, latency time.Duration, err error) {
+	rise := healthThreshold(config().Tracker.HealthRise, common.DefaultHealthRise)
+	fall := healthThreshold(config().Tracker.HealthFall, common.DefaultHealthFall)
+	now := time.Now().Unix()
+
+	h := &t.health
+	h.mu.Lock()
+	key := storageRecordKey(s.Group, s.Addr)
+	st, ok := h.states[key]
+	if !ok {
+		st = &HealthState{Group: s.Group, Addr: s.Addr, Up: s.Status != common.StorageOffline}
+		h.states[key] = st
+	}
+	st.LastCheck, st.Latency = now, latency.Milliseconds()
+	var changed *HealthTransition
+	if err == nil {
+		st.Failures, st.LastError = 0, ""
+		st.Successes++
+		if !st.Up && st.Successes >= rise {
+			st.Up = true
+			changed = &HealthTransition{Group: s.Group, Addr: s.Addr, Up: true, Time: now}
+		}
+	} else {
+		st.Successes, st.LastError = 0, err.Error()
+		st.Failures++
+		if st.Up && st.Failures >= fall {
+			st.Up = false
+			changed = &HealthTransition{Group: s.Group, Addr: s.Addr, Up: false, Reason: err.Error(), Time: now}
+		}
+	}
+	if changed != nil {
+		h.history = append(h.history, *changed)
+		if len(h.history) > healthHistorySize {
+			h.history = h.history[len(h.history)-healthHistorySize:]
+		}
+	}
+	h.mu.Unlock()
+
+	if changed == nil {
+		return
+	}
+	if changed.Up {
+		logger.Info("storage health up", zap.String("group", s.Group), zap.String("addr", s.Addr))
+	} else {
+		logger.Warn("storage health down", zap.String("group", s.Group), zap.String("addr", s.Addr), zap.String("reason", changed.Reason))
+	}
+	if !t.cluster.IsLeader() {
+		return
+	}
+	//心跳会更新storage 使用当前注册的storage
+	if g := t.GetGroup(s.Group); g != nil {
+		if cur := g.GetStorage(s.Addr); cur != nil {
+			s = cur
+		}
+	}
+	if changed.Up {
+		//心跳仍然正常时恢复为等待确认 否则等待下一次心跳
+		if s.Status == common.StorageOffline && now-s.UpdateTime <= storageExpire {
+			t.setStorageStatus(s, common.StoragePending)
+		}
+	} else if s.Status != common.StorageMaintenance && s.Status != common.StorageOffline {
+		t.setStorageStatus(s, common.StorageOffline)
+	}
+}
+
+//healthDown 健康检查是否判定storage离线
+func (t *Tracker) healthDown(group, addr string) bool {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	st, ok := t.health.states[storageRecordKey(group, addr)]
+	return ok && !st.Up
+}
+
+//cleanHealthStates 删除已移除的storage的检查状态
+func (t *Tracker) cleanHealthStates() {
+	exist := make(map[string]bool)
+	for _, g := range t.GetGroups() {
+		for _, s := range g.GetStorages() {
+			exist[storageRecordKey(s.Group, s.Addr)] = true
+		}
+	}
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	for key := range t.health.states {
+		if !exist[key] {
+			delete(t.health.states, key)
+		}
+	}
+}
+
+//Health api 健康检查状态与状态变化记录 可按group与addr过滤 limit为返回的记录数
+func (t *Tracker) Health(c *gin.Context) {
+	group, addr := c.Query("group"), c.Query("addr")
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	match := func(g, a string) bool {
+		return (group == "" || g == group) && (addr == "" || a == addr)
+	}
+	info := HealthInfo{
+		Storages: make([]HealthState, 0),
+		History:  make([]HealthTransition, 0),
+	}
+	t.health.mu.Lock()
+	for _, st := range t.health.states {
+		if match(st.Group, st.Addr) {
+			info.Storages = append(info.Storages, *st)
+		}
+	}
+	for i := len(t.health.history) - 1; i >= 0; i-- {
+		if limit > 0 && len(info.History) >= limit {
+			break
+		}
+		if tr := t.health.history[i]; match(tr.Group, tr.Addr) {
+			info.History = append(info.History, tr)
+		}
+	}
+	t.health.mu.Unlock()
+	sort.Slice(info.Storages, func(i, j int) bool {
+		if info.Storages[i].Group == info.Storages[j].Group {
+			return info.Storages[i].Addr < info.Storages[j].Addr
+		}
+		return info.Storages[i].Group < info.Storages[j].Group
+	})
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   info,
+	})
+}
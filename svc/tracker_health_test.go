@@ -0,0 +1,81 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"errors"
+	"testing"
+	"time"
+)
+
+//statusConsensus 测试用的Consensus 只应用storage状态的修改
+type statusConsensus struct {
+	t      *Tracker
+	leader bool
+}
+
+func (sc *statusConsensus) Apply(cmd *Command) error {
+	if cmd.Op == cmdStorageStatus {
+		if s := sc.t.GetGroup(cmd.Storage.Group).GetStorage(cmd.Storage.Addr); s != nil {
+			s.Status = cmd.Storage.Status
+		}
+	}
+	return nil
+}
+
+func (sc *statusConsensus) IsLeader() bool {
+	return sc.leader
+}
+
+func (sc *statusConsensus) Status() map[string]interface{} {
+	return nil
+}
+
+func TestRecordProbe(t *testing.T) {
+	cfg := config()
+	rise, fall := cfg.Tracker.HealthRise, cfg.Tracker.HealthFall
+	defer func() {
+		cfg.Tracker.HealthRise, cfg.Tracker.HealthFall = rise, fall
+	}()
+	cfg.Tracker.HealthRise, cfg.Tracker.HealthFall = 2, 3
+
+	cases := []struct {
+		name     string
+		status   int
+		stale    bool   //心跳已超时
+		follower bool   //非leader只记录检查结果
+		probes   string //S成功 F失败
+		up       bool
+		want     int
+		changes  int
+	}{
+		{"below fall", common.StorageActive, false, false, "FF", true, common.StorageActive, 0},
+		{"failures reset by success", common.StorageActive, false, false, "FFSFF", true, common.StorageActive, 0},
+		{"down", common.StorageActive, false, false, "FFF", false, common.StorageOffline, 1},
+		{"below rise", common.StorageActive, false, false, "FFFS", false, common.StorageOffline, 1},
+		{"up", common.StorageActive, false, false, "FFFSS", true, common.StoragePending, 2},
+		{"up with stale heartbeat", common.StorageActive, true, false, "FFFSS", true, common.StorageOffline, 2},
+		{"maintenance kept", common.StorageMaintenance, false, false, "FFF", false, common.StorageMaintenance, 1},
+		{"follower", common.StorageActive, false, true, "FFF", false, common.StorageActive, 1},
+	}
+	for _, tc := range cases {
+		s := &StorageServer{Group: "g1", Addr: "127.0.0.1:8080", Status: tc.status, UpdateTime: time.Now().Unix()}
+		if tc.stale {
+			s.UpdateTime -= storageExpire * 2
+		}
+		tr := &Tracker{
+			groups: map[string]*Group{"g1": {Name: "g1", Storages: map[string]*StorageServer{s.Addr: s}}},
+			health: healthChecker{states: make(map[string]*HealthState)},
+		}
+		tr.cluster = &statusConsensus{t: tr, leader: !tc.follower}
+		for _, p := range tc.probes {
+			var err error
+			if p == 'F' {
+				err = errors.New("connection refused")
+			}
+			tr.recordProbe(s, time.Millisecond, err)
+		}
+		if tr.healthDown(s.Group, s.Addr) == tc.up || s.Status != tc.want || len(tr.health.history) != tc.changes {
+			t.Errorf("%s: up %v status %d changes %d", tc.name, !tr.healthDown(s.Group, s.Addr), s.Status, len(tr.health.history))
+		}
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"eggdfs/common"
 	"eggdfs/common/model"
 	"eggdfs/svc/proxy"
+	"eggdfs/util"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -19,6 +21,7 @@ import (
 type TrackerProxy struct {
 	proxy.Entity
 	Group   string
+	Err     error //RetryErrorHandler记录的代理错误
 	tracker *Tracker
 	c       *gin.Context
 }
@@ -45,6 +48,8 @@ func (tp *TrackerProxy) HttpProxy(w http.ResponseWriter, r *http.Request, handle
 		return err
 	}
 	rp := httputil.NewSingleHostReverseProxy(remote)
+	//客户端请求不使用节点凭证
+	rp.Transport = util.ProxyTransport()
 	r.URL.Host = remote.Host
 	r.URL.Scheme = remote.Scheme
 	r.Header.Set("X-Forward-Host", r.Header.Get("Host"))
@@ -55,15 +60,36 @@ func (tp *TrackerProxy) HttpProxy(w http.ResponseWriter, r *http.Request, handle
 	if handler != nil {
 		rp.ErrorHandler = handler
 	}
+	done := tp.tracker.trackInFlight(tp.Addr)
+	defer done()
 	rp.ServeHTTP(w, r)
 	return nil
 }
 
 //AbortErrorHandler 错误处理机制，直接返回
 func (tp *TrackerProxy) AbortErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	tp.markOffline()
+	tp.writeBadGateway(w, err)
+}
+
+//RetryErrorHandler 错误处理机制，只记录错误，由调用方决定是否切换storage重试
+func (tp *TrackerProxy) RetryErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	tp.markOffline()
+	tp.Err = err
+}
+
+//markOffline 代理失败的storage经集群提交为离线
+func (tp *TrackerProxy) markOffline() {
 	group := tp.tracker.GetGroup(tp.Group)
-	group.GetStorage(tp.Addr).Status = common.StorageOffline
+	if group == nil {
+		return
+	}
+	if s := group.GetStorage(tp.Addr); s != nil && s.Status != common.StorageOffline {
+		tp.tracker.setStorageStatus(s, common.StorageOffline)
+	}
+}
 
+func (tp *TrackerProxy) writeBadGateway(w http.ResponseWriter, err error) {
 	res := model.RespResult{
 		Status:  common.ProxyBadGateWay,
 		Message: err.Error(),
@@ -72,3 +98,20 @@ func (tp *TrackerProxy) AbortErrorHandler(w http.ResponseWriter, req *http.Reque
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 	_, _ = w.Write(bytes)
 }
+
+//countingBody 统计已发送到后端的请求体字节数
+//Close不关闭原始body，失败后可在未发送任何数据时重试
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	return nil
+}
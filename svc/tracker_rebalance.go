@@ -0,0 +1,446 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+//跨group迁移
+//group剩余容量相差超过rebalance_threshold时，从剩余容量最小的group迁移文件到剩余容量最大的group，
+//每轮迁移两者差值的一半且不超过rebalance_max_size。文件复制到目标group后记录跳转，
+//原group/path以及file id仍可访问，随后删除原group中的文件。迁移只由leader执行，
+//计划与进度保存在共享的rebalance库中，leader切换或重启后从上次完成的位置继续
+
+const (
+	redirectDBName  = "redirect"
+	rebalanceDBName = "rebalance"
+	rebalanceKey    = "current"
+)
+
+//maxRedirectHops 多次迁移后跳转的最大次数
+const maxRedirectHops = 8
+
+//rebalanceState 当前tracker是否正在执行迁移
+type rebalanceState struct {
+	mu      sync.Mutex
+	running bool
+}
+
+func redirectPathKey(group, file string) string {
+	return "path@" + group + "/" + strings.TrimPrefix(file, "/")
+}
+
+func redirectIdKey(fileId string) string {
+	return "id@" + fileId
+}
+
+//resolveRedirect 文件迁移后所在的group与路径 没有迁移时原样返回
+func (t *Tracker) resolveRedirect(group, file string) (string, string) {
+	file = strings.TrimPrefix(file, "/")
+	for i := 0; i < maxRedirectHops; i++ {
+		data, err := t.redirectDB.Get(redirectPathKey(group, file))
+		if err != nil {
+			break
+		}
+		var r model.FileRedirect
+		if err = json.Unmarshal(data, &r); err != nil {
+			break
+		}
+		group, file = r.Group, r.Path
+	}
+	return group, file
+}
+
+//redirectGroup file id迁移后所在的group
+func (t *Tracker) redirectGroup(fileId string) string {
+	data, err := t.redirectDB.Get(redirectIdKey(fileId))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+//rebalanceThreshold 触发迁移的剩余容量差比例
+func rebalanceThreshold() float64 {
+	if v := config().Tracker.RebalanceThreshold; v > 0 {
+		return v
+	}
+	return common.DefaultRebalanceThreshold
+}
+
+//rebalanceSpec 自动迁移的cron表达式 未配置时返回空
+func rebalanceSpec() string {
+	interval := config().Tracker.RebalanceInterval
+	if interval <= 0 {
+		return ""
+	}
+	return "@every " + (time.Duration(interval) * time.Minute).String()
+}
+
+//planRebalance 生成迁移计划 group容量均衡时返回空计划
+func (t *Tracker) planRebalance() (*model.RebalancePlan, error) {
+	gs := t.activeGroups()
+	if len(gs) < 2 {
+		return nil, errors.New("at least two writable groups required")
+	}
+	src, dst := gs[0], gs[0]
+	for _, g := range gs[1:] {
+		if g.Cap < src.Cap {
+			src = g
+		}
+		if g.Cap > dst.Cap {
+			dst = g
+		}
+	}
+	plan := &model.RebalancePlan{Source: src.Name, Target: dst.Name, Moves: make([]model.RebalanceMove, 0)}
+	diff := dst.Cap - src.Cap
+	if src == dst || float64(diff) <= rebalanceThreshold()*float64(dst.Cap) {
+		return plan, nil
+	}
+	quota := int64(diff / 2)
+	maxSize := config().Tracker.RebalanceMaxSize
+	if maxSize <= 0 {
+		maxSize = common.DefaultRebalanceMaxSize
+	}
+	if maxSize<<20 < quota {
+		quota = maxSize << 20
+	}
+
+	peer := src.NextStorage(nil, (*StorageServer).Servable)
+	if peer == nil {
+		return nil, errors.New("no available storage for group: " + src.Name)
+	}
+	after := ""
+	for plan.Bytes < quota {
+		page, err := t.fetchStorageCatalog(peer, after)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Files) == 0 {
+			break
+		}
+		for _, entry := range page.Files {
+			after = entry.Md5
+			if entry.Size <= 0 || plan.Bytes+entry.Size > quota {
+				continue
+			}
+			refs := entry.Refs
+			if len(refs) == 0 {
+				refs = []model.FileRef{{FileId: entry.FileId}}
+			}
+			plan.Moves = append(plan.Moves, model.RebalanceMove{
+				Md5:  entry.Md5,
+				Path: strings.TrimPrefix(entry.Path, "/"),
+				Size: entry.Size,
+				Refs: refs,
+				Src:  peer.Addr,
+			})
+			plan.Bytes += entry.Size
+		}
+	}
+	return plan, nil
+}
+
+//getRebalance 获取最近一次迁移任务
+func (t *Tracker) getRebalance() (*model.RebalanceTask, error) {
+	data, err := t.rebalanceDB.Get(rebalanceKey)
+	if err != nil {
+		return nil, errors.New("no rebalance")
+	}
+	var task model.RebalanceTask
+	if err = json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (t *Tracker) putRebalance(task *model.RebalanceTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return t.rebalanceDB.Put(rebalanceKey, data)
+}
+
+//startRebalance 保存迁移计划并在后台执行 已有迁移在执行时返回错误
+func (t *Tracker) startRebalance(plan *model.RebalancePlan) error {
+	t.rebalance.mu.Lock()
+	if cur, err := t.getRebalance(); err == nil && cur.Status.Running {
+		t.rebalance.mu.Unlock()
+		return errors.New("rebalance already running")
+	}
+	task := &model.RebalanceTask{
+		Plan: *plan,
+		Status: model.RebalanceStatus{
+			Running:   true,
+			Source:    plan.Source,
+			Target:    plan.Target,
+			Planned:   len(plan.Moves),
+			StartTime: time.Now().Unix(),
+		},
+	}
+	err := t.putRebalance(task)
+	t.rebalance.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	go t.RunRebalance()
+	return nil
+}
+
+//RunRebalance 从上次完成的位置继续执行未完成的迁移 只由leader执行
+//每批迁移rebalance_concurrency个文件，一批完成后保存进度，leader切换时停止
+func (t *Tracker) RunRebalance() {
+	if !t.cluster.IsLeader() {
+		return
+	}
+	t.rebalance.mu.Lock()
+	if t.rebalance.running {
+		t.rebalance.mu.Unlock()
+		return
+	}
+	t.rebalance.running = true
+	t.rebalance.mu.Unlock()
+	defer func() {
+		t.rebalance.mu.Lock()
+		t.rebalance.running = false
+		t.rebalance.mu.Unlock()
+	}()
+
+	task, err := t.getRebalance()
+	if err != nil || !task.Status.Running {
+		return
+	}
+	workers := config().Tracker.RebalanceConcurrency
+	if workers <= 0 {
+		workers = common.DefaultRebalanceConcurrency
+	}
+	limiter := newRateLimiter(config().Tracker.RebalanceBandwidth << 20)
+	status := &task.Status
+	for status.Cursor < len(task.Plan.Moves) {
+		if !t.cluster.IsLeader() {
+			return
+		}
+		end := status.Cursor + workers
+		if end > len(task.Plan.Moves) {
+			end = len(task.Plan.Moves)
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, m := range task.Plan.Moves[status.Cursor:end] {
+			wg.Add(1)
+			go func(m model.RebalanceMove) {
+				defer wg.Done()
+				limiter.Wait(m.Size)
+				err := t.moveFile(&task.Plan, m)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					status.Failed++
+					status.LastError = err.Error()
+					logger.Warn("rebalance move fail", zap.String("md5", m.Md5), zap.Error(err))
+				} else {
+					status.Moved++
+					status.Bytes += m.Size
+				}
+			}(m)
+		}
+		wg.Wait()
+		status.Cursor = end
+		if err = t.putRebalance(task); err != nil {
+			logger.Error("rebalance save fail", zap.Error(err))
+			return
+		}
+	}
+
+	status.Running = false
+	status.EndTime = time.Now().Unix()
+	if err = t.putRebalance(task); err != nil {
+		logger.Error("rebalance save fail", zap.Error(err))
+	}
+	logger.Info("rebalance finished", zap.Any("status", status))
+}
+
+//moveFile 复制文件到目标group并记录跳转 然后删除原group中的文件
+func (t *Tracker) moveFile(plan *model.RebalancePlan, m model.RebalanceMove) error {
+	sg, dg := t.GetGroup(plan.Source), t.GetGroup(plan.Target)
+	if sg == nil || dg == nil {
+		return errors.New("no such group")
+	}
+	src := sg.GetStorage(m.Src)
+	if src == nil {
+		return errors.New("no such storage: " + m.Src)
+	}
+	dst, err := t.SelectStorageForUpload(m.Md5, dg)
+	if err != nil {
+		return err
+	}
+	if !dst.Replicable() {
+		return errors.New("dst storage unavailable: " + dst.Addr)
+	}
+
+	for _, ref := range m.Refs {
+		info := model.SyncFileInfo{
+			Src:      src.HttpSchema + "://" + src.Addr,
+			Dst:      dst.HttpSchema + "://" + dst.Addr,
+			FileId:   ref.FileId,
+			FilePath: path.Dir(m.Path),
+			FileName: path.Base(m.Path),
+			FileHash: m.Md5,
+			Action:   common.SyncAdd,
+			Group:    dg.Name,
+			SrcGroup: sg.Name,
+		}
+		//经同步队列立即执行 失败时不再重试 原文件保持不变
+		if err = t.syncNow(info); err != nil {
+			return err
+		}
+	}
+	//目标storage上已有相同文件时引用指向已有的路径
+	fi, err := t.getStorageFileInfo(dst, m.Refs[0].FileId)
+	if err != nil {
+		return err
+	}
+	target := strings.TrimPrefix(fi.Path, "/")
+
+	data, _ := json.Marshal(model.FileRedirect{Group: dg.Name, Path: target})
+	if err = t.redirectDB.Put(redirectPathKey(sg.Name, m.Path), data); err != nil {
+		return err
+	}
+	for _, ref := range m.Refs {
+		if err = t.redirectDB.Put(redirectIdKey(ref.FileId), []byte(dg.Name)); err != nil {
+			return err
+		}
+		t.fileGroups.Store(ref.FileId, dg.Name)
+	}
+
+	//同步到目标group内其他storage 删除原group中的文件
+	for _, s := range dg.GetStorages() {
+		if s.Addr == dst.Addr {
+			continue
+		}
+		for _, ref := range m.Refs {
+			t.SyncFile(s, model.SyncFileInfo{
+				Src:      dst.HttpSchema + "://" + dst.Addr,
+				Dst:      s.HttpSchema + "://" + s.Addr,
+				FileId:   ref.FileId,
+				FilePath: path.Dir(target),
+				FileName: path.Base(target),
+				FileHash: m.Md5,
+				Action:   common.SyncAdd,
+				Group:    dg.Name,
+			})
+		}
+	}
+	for _, s := range sg.GetStorages() {
+		for _, ref := range m.Refs {
+			t.SyncFile(s, model.SyncFileInfo{
+				Dst:      s.HttpSchema + "://" + s.Addr,
+				FileId:   ref.FileId,
+				FilePath: path.Dir(m.Path),
+				FileName: path.Base(m.Path),
+				FileHash: m.Md5,
+				Action:   common.SyncDelete,
+				Group:    sg.Name,
+			})
+		}
+	}
+	return nil
+}
+
+//AutoRebalance 定时检查group容量并执行迁移 只由leader执行
+func (t *Tracker) AutoRebalance() {
+	if !t.cluster.IsLeader() {
+		return
+	}
+	plan, err := t.planRebalance()
+	if err != nil || len(plan.Moves) == 0 {
+		return
+	}
+	if err = t.startRebalance(plan); err == nil {
+		logger.Info("rebalance started", zap.String("source", plan.Source), zap.String("target", plan.Target),
+			zap.Int("files", len(plan.Moves)), zap.Int64("bytes", plan.Bytes))
+	}
+}
+
+//Rebalance api 执行跨group迁移 dry_run为true时只返回迁移计划
+func (t *Tracker) Rebalance(c *gin.Context) {
+	var params struct {
+		DryRun bool `json:"dry_run" form:"dry_run"`
+	}
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if !params.DryRun && !t.cluster.IsLeader() {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "not leader"})
+		return
+	}
+	plan, err := t.planRebalance()
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	if !params.DryRun && len(plan.Moves) > 0 {
+		if err = t.startRebalance(plan); err != nil {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   plan,
+	})
+}
+
+//RebalanceStatus api 最近一次迁移的进度
+func (t *Tracker) RebalanceStatus(c *gin.Context) {
+	var status model.RebalanceStatus
+	if task, err := t.getRebalance(); err == nil {
+		status = task.Status
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   status,
+	})
+}
+
+//rateLimiter 按字节数限制速率 rate为每秒字节数 不大于0时不限制
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+//Wait 预占n字节的发送时间 等待到可以发送时返回
+func (l *rateLimiter) Wait(n int64) {
+	if l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
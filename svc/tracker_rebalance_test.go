@@ -0,0 +1,140 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//catalogServer 按md5顺序分页返回文件目录的storage
+func catalogServer(entries []model.CatalogEntry) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		after := r.URL.Query().Get("after")
+		page := model.CatalogPage{Total: int64(len(entries)), Files: make([]model.CatalogEntry, 0)}
+		for _, e := range entries {
+			if e.Md5 > after && len(page.Files) < 2 {
+				page.Files = append(page.Files, e)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(model.RespResult{Status: common.Success, Data: page})
+	}))
+}
+
+func rebalanceGroup(name string, capKB uint64, addr string, status int) *Group {
+	g := &Group{Name: name, Status: common.GroupActive, Cap: capKB << 10, Storages: make(map[string]*StorageServer)}
+	g.Storages[addr] = &StorageServer{Group: name, Addr: addr, HttpSchema: "http", Status: status}
+	return g
+}
+
+func TestPlanRebalance(t *testing.T) {
+	const kb = 1 << 10
+	entry := func(md5 string, size int64, refs ...string) model.CatalogEntry {
+		e := model.CatalogEntry{FileInfo: model.FileInfo{FileId: "id-" + md5, Md5: md5, Path: "/2021/1/1/" + md5 + ".txt", Size: size}}
+		for _, ref := range refs {
+			e.Refs = append(e.Refs, model.FileRef{FileId: ref})
+		}
+		return e
+	}
+	srv := catalogServer([]model.CatalogEntry{
+		entry("a1", 400*kb, "r1", "r2"),
+		entry("a2", 400*kb),
+		entry("a3", 400*kb),
+		entry("a4", 0),
+		entry("a5", 100*kb),
+	})
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	cfg := config()
+	threshold, maxSize := cfg.Tracker.RebalanceThreshold, cfg.Tracker.RebalanceMaxSize
+	defer func() {
+		cfg.Tracker.RebalanceThreshold, cfg.Tracker.RebalanceMaxSize = threshold, maxSize
+	}()
+	cfg.Tracker.RebalanceThreshold = 0.2
+
+	cases := []struct {
+		name    string
+		groups  []*Group
+		maxSize int64 //MB
+		err     bool
+		moves   []string
+	}{
+		{"single group", []*Group{rebalanceGroup("g1", 102400, addr, common.StorageActive)}, 1, true, nil},
+		{"balanced", []*Group{
+			rebalanceGroup("g1", 102400, addr, common.StorageActive),
+			rebalanceGroup("g2", 112640, "127.0.0.1:1", common.StorageActive),
+		}, 1, false, []string{}},
+		{"quota", []*Group{
+			rebalanceGroup("g1", 102400, addr, common.StorageActive),
+			rebalanceGroup("g2", 1024000, "127.0.0.1:1", common.StorageActive),
+		}, 1, false, []string{"a1", "a2", "a5"}},
+		{"half of difference", []*Group{
+			rebalanceGroup("g1", 2000, "127.0.0.1:1", common.StorageActive),
+			rebalanceGroup("g2", 400, addr, common.StorageActive),
+		}, 1024, false, []string{"a1", "a2"}},
+		{"not writable group skipped", []*Group{
+			rebalanceGroup("g1", 102400, addr, common.StorageActive),
+			rebalanceGroup("g2", 1024000, "127.0.0.1:1", common.StorageDraining),
+		}, 1, true, nil},
+	}
+	for _, tc := range cases {
+		cfg.Tracker.RebalanceMaxSize = tc.maxSize
+		tr := &Tracker{groups: make(map[string]*Group)}
+		for _, g := range tc.groups {
+			tr.groups[g.Name] = g
+		}
+		plan, err := tr.planRebalance()
+		if (err != nil) != tc.err {
+			t.Errorf("%s: err %v", tc.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := make([]string, 0)
+		var bytes int64
+		for _, m := range plan.Moves {
+			got = append(got, m.Md5)
+			bytes += m.Size
+			if m.Src != addr || len(m.Refs) == 0 || strings.HasPrefix(m.Path, "/") {
+				t.Errorf("%s: invalid move %+v", tc.name, m)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.moves, ",") || bytes != plan.Bytes {
+			t.Errorf("%s: moves %v bytes %d", tc.name, got, plan.Bytes)
+		}
+		if len(plan.Moves) > 0 && len(plan.Moves[0].Refs) != 2 {
+			t.Errorf("%s: refs %v", tc.name, plan.Moves[0].Refs)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	cases := []struct {
+		name  string
+		rate  int64
+		sizes []int64
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"unlimited", 0, []int64{1 << 30, 1 << 30}, 0, 50 * time.Millisecond},
+		{"first send not delayed", 1000, []int64{100}, 0, 50 * time.Millisecond},
+		//第三次发送需要等待前两次预占的时间
+		{"limited", 1000, []int64{100, 100, 100}, 180 * time.Millisecond, 400 * time.Millisecond},
+	}
+	for _, tc := range cases {
+		l := newRateLimiter(tc.rate)
+		start := time.Now()
+		for _, n := range tc.sizes {
+			l.Wait(n)
+		}
+		if d := time.Since(start); d < tc.min || d > tc.max {
+			t.Errorf("%s: waited %v, want [%v, %v]", tc.name, d, tc.min, tc.max)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const syncInFlight = 30
+
+//SyncFile 同步函数 任务先持久化到同步队列再执行，失败后由队列重试 返回本次是否同步成功
+func (t *Tracker) SyncFile(sm *StorageServer, sync model.SyncFileInfo) bool {
+	task, err := t.syncQueue.Push(sync)
+	if err != nil {
+		logger.Error("sync task push fail", zap.Any("info", sync), zap.Error(err))
+		return false
+	}
+	t.runSyncFileTasks(task.FileKey)
+	_, err = t.syncQueue.Get(task.Id)
+	return err != nil
+}
+
+//RepairSyncFail 执行队列中到期的同步任务 集群中只由leader执行
+//刚入队的任务由入队的tracker立即执行，超过syncInFlight秒仍未执行的任务才由队列执行
+func (t *Tracker) RepairSyncFail() {
+	if !t.cluster.IsLeader() {
+		return
+	}
+	now := time.Now().Unix()
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, task := range t.syncQueue.List(common.SyncTaskPending, 0) {
+		if seen[task.FileKey] || task.NextRetry > now {
+			continue
+		}
+		if task.Attempts == 0 && task.NextRetry == 0 && now-task.CreateTime < syncInFlight {
+			continue
+		}
+		seen[task.FileKey] = true
+		keys = append(keys, task.FileKey)
+	}
+	for _, key := range keys {
+		t.runSyncFileTasks(key)
+	}
+}
+
+//runSyncFileTasks 按入队顺序执行同一文件的同步任务，遇到失败、未到重试时间或已放弃的任务即停止
+//已放弃的任务需要运维重试或清除后才继续执行之后的任务
+func (t *Tracker) runSyncFileTasks(fileKey string) {
+	unlock := t.syncQueue.LockFile(fileKey)
+	defer unlock()
+	now := time.Now().Unix()
+	for _, task := range t.syncQueue.FileTasks(fileKey) {
+		if task.State == common.SyncTaskDead || task.NextRetry > now {
+			return
+		}
+		delay, err := t.execSyncTask(task)
+		if delay != "" {
+			_ = t.syncQueue.Delay(task, delay)
+			return
+		}
+		if err != nil {
+			logger.Warn("sync task fail", zap.String("id", task.Id), zap.Int("attempts", task.Attempts+1), zap.Error(err))
+			_ = t.syncQueue.Fail(task, err)
+			if task.State == common.SyncTaskDead {
+				logger.Error("sync task dead", zap.String("id", task.Id), zap.Any("info", task.Info))
+			}
+			return
+		}
+		_ = t.syncQueue.Remove(task)
+	}
+}
+
+//syncNow 同步任务经同步队列立即执行 保证同一文件的任务顺序，没有完成时从队列中移除并返回原因 由调用方决定是否重试
+func (t *Tracker) syncNow(info model.SyncFileInfo) error {
+	task, err := t.syncQueue.Push(info)
+	if err != nil {
+		return err
+	}
+	t.runSyncFileTasks(task.FileKey)
+	unlock := t.syncQueue.LockFile(task.FileKey)
+	defer unlock()
+	if task, err = t.syncQueue.Get(task.Id); err != nil {
+		return nil
+	}
+	_ = t.syncQueue.Remove(task)
+	if task.LastError != "" {
+		return errors.New(task.LastError)
+	}
+	return errors.New("sync task blocked by earlier tasks of the same file")
+}
+
+//execSyncTask 执行同步任务 相关storage不可用时返回推迟原因
+func (t *Tracker) execSyncTask(task *model.SyncTask) (delay string, err error) {
+	info := task.Info
+	g := t.GetGroup(info.Group)
+	if g == nil {
+		return "no such group", nil
+	}
+	dst := g.GetStorage(storageAddr(info.Dst))
+	if dst == nil || !dst.Replicable() {
+		return "dst storage unavailable", nil
+	}
+	if info.Action == common.SyncAdd {
+		sg := g
+		if info.SrcGroup != "" {
+			if sg = t.GetGroup(info.SrcGroup); sg == nil {
+				return "no such src group", nil
+			}
+		}
+		src := sg.GetStorage(storageAddr(info.Src))
+		if src == nil || !(src.Replicable() || src.Status == common.StorageReadOnly) {
+			return "src storage unavailable", nil
+		}
+	}
+
+	//在大文件下这个方法完全不可行
+	resp, err := util.HttpPost(info.Dst+"/sync", info, nil, time.Second*30)
+	if err != nil {
+		return "", err
+	}
+	var res model.RespResult
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return "", err
+	}
+	if res.Status != common.Success {
+		return "", errors.New("sync fail: status " + strconv.Itoa(res.Status) + " " + res.Message)
+	}
+	return "", nil
+}
+
+//storageAddr 从schema://addr中解析addr
+func storageAddr(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	return u.Host
+}
+
+//migrateSyncErrLog 将旧版本sync-err中记录的同步失败导入同步队列
+func (t *Tracker) migrateSyncErrLog() {
+	const legacyName = "sync-err"
+	if !model.IsExistDB(legacyName) {
+		return
+	}
+	legacy := model.NewEggDB(legacyName)
+	defer legacy.Ldb.Close()
+	keys := make([]string, 0)
+	_ = legacy.Range("", func(key, value []byte) bool {
+		var sfi model.SyncFileInfo
+		if err := json.Unmarshal(value, &sfi); err == nil {
+			if _, err = t.syncQueue.Push(sfi); err != nil {
+				return false
+			}
+		}
+		keys = append(keys, string(key))
+		return true
+	})
+	_ = legacy.Delete(keys...)
+	if len(keys) > 0 {
+		logger.Info("sync-err migrated to sync queue", zap.Int("count", len(keys)))
+	}
+}
+
+//SyncTasks api 列出同步任务 state: PENDING||DEAD 为空时列出所有任务
+func (t *Tracker) SyncTasks(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   t.syncQueue.List(c.Query("state"), limit),
+	})
+}
+
+//SyncRetry api 重试同步任务 id为空时重试所有死信任务
+func (t *Tracker) SyncRetry(c *gin.Context) {
+	var params struct {
+		Id string `json:"id" form:"id"`
+	}
+	_ = c.ShouldBind(&params)
+	tasks, err := t.selectSyncTasks(params.Id, common.SyncTaskDead)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	keys := make(map[string]bool)
+	for _, task := range tasks {
+		if err = t.syncQueue.Retry(task); err == nil {
+			keys[task.FileKey] = true
+		}
+	}
+	go func() {
+		for key := range keys {
+			t.runSyncFileTasks(key)
+		}
+	}()
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   len(tasks),
+	})
+}
+
+//SyncPurge api 清理同步任务 指定id或state
+func (t *Tracker) SyncPurge(c *gin.Context) {
+	var params struct {
+		Id    string `json:"id" form:"id"`
+		State string `json:"state" form:"state"`
+	}
+	_ = c.ShouldBind(&params)
+	if params.Id == "" && params.State == "" {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ParamBindFail,
+			Message: "id or state required",
+		})
+		return
+	}
+	tasks, err := t.selectSyncTasks(params.Id, params.State)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	for _, task := range tasks {
+		_ = t.syncQueue.Remove(task)
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   len(tasks),
+	})
+}
+
+//selectSyncTasks 指定id时返回该任务，否则返回state的所有任务
+func (t *Tracker) selectSyncTasks(id, state string) ([]*model.SyncTask, error) {
+	if id == "" {
+		return t.syncQueue.List(state, 0), nil
+	}
+	task, err := t.syncQueue.Get(id)
+	if err != nil {
+		return nil, errors.New("no such task")
+	}
+	return []*model.SyncTask{task}, nil
+}
@@ -0,0 +1,210 @@
+package svc
+
+import (
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//分片上传与断点续传上传 tracker端
+//创建上传时选择storage并记录上传会话，后续请求均转发到同一storage
+
+//ChunkInit api 分片上传初始化
+func (t *Tracker) ChunkInit(c *gin.Context) {
+	t.createUpload(c)
+}
+
+//ChunkUpload api 上传分片
+func (t *Tracker) ChunkUpload(c *gin.Context) {
+	t.proxyUpload(c, c.Query("upload_id"))
+}
+
+//ChunkComplete api 合并分片 成功后同步到group内其他storage
+func (t *Tracker) ChunkComplete(c *gin.Context) {
+	t.proxyUpload(c, c.Query("upload_id"))
+}
+
+//ChunkAbort api 取消分片上传
+func (t *Tracker) ChunkAbort(c *gin.Context) {
+	uploadId := c.Query("upload_id")
+	t.proxyUpload(c, uploadId)
+	_ = t.uploadDB.Delete(uploadId)
+}
+
+//ResumableCreate api 创建断点续传上传
+func (t *Tracker) ResumableCreate(c *gin.Context) {
+	t.createUpload(c)
+}
+
+//ResumableHead api 查询断点续传偏移量
+func (t *Tracker) ResumableHead(c *gin.Context) {
+	group, s, err := t.getUploadStorage(c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	p := NewTrackerProxy(s.HttpSchema, s.Addr, group.Name, t, c)
+	if err = t.httpProxy(p, c); err != nil {
+		logger.Error(err.Error())
+		c.Status(http.StatusBadGateway)
+	}
+}
+
+//ResumablePatch api 断点续传写入数据 上传完成后同步到group内其他storage
+func (t *Tracker) ResumablePatch(c *gin.Context) {
+	t.proxyUpload(c, c.Param("id"))
+}
+
+//ResumableAbort api 取消断点续传上传
+func (t *Tracker) ResumableAbort(c *gin.Context) {
+	uploadId := c.Param("id")
+	t.proxyUpload(c, uploadId)
+	_ = t.uploadDB.Delete(uploadId)
+}
+
+//createUpload 选择storage创建上传会话
+func (t *Tracker) createUpload(c *gin.Context) {
+	wc := t.beginWriteConcern(c)
+	if wc == nil {
+		return
+	}
+	defer wc.finish(c)
+	group, err := t.SelectGroupForUpload(c.Request)
+	if err != nil {
+		logger.Error(err.Error())
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	s, err := t.SelectStorageForUpload(c.ClientIP(), group)
+	if err != nil {
+		logger.Error(err.Error())
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	//upload id即文件id
+	uuid := util.GenFileUUID()
+	c.Request.Header.Set(common.HeaderFileUUID, uuid)
+	//先记录会话，防止客户端在代理返回后立即上传数据
+	if err = t.putUploadRoute(uuid, group.Name, s.Addr); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	p := NewTrackerProxy(s.HttpSchema, s.Addr, group.Name, t, c)
+	if err = t.httpProxy(p, c); err != nil {
+		_ = t.uploadDB.Delete(uuid)
+		logger.Error(err.Error())
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	//秒传或创建失败时storage不会返回upload id
+	if c.Writer.Header().Get(common.HeaderUploadId) != uuid {
+		_ = t.uploadDB.Delete(uuid)
+	}
+	//秒传成功 同步引用
+	t.syncUploadedFile(c, group, s, uuid)
+}
+
+//proxyUpload 将上传请求转发到会话所在的storage 上传完成时同步文件
+func (t *Tracker) proxyUpload(c *gin.Context, uploadId string) {
+	wc := t.beginWriteConcern(c)
+	if wc == nil {
+		return
+	}
+	defer wc.finish(c)
+	group, s, err := t.getUploadStorage(uploadId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.ChunkUploadNotFound,
+			Message: err.Error(),
+		})
+		return
+	}
+	_ = t.putUploadRoute(uploadId, group.Name, s.Addr)
+
+	p := NewTrackerProxy(s.HttpSchema, s.Addr, group.Name, t, c)
+	if err = t.httpProxy(p, c); err != nil {
+		logger.Error(err.Error())
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.Fail,
+			Message: err.Error(),
+		})
+		return
+	}
+	if c.Writer.Header().Get(common.HeaderFileUploadRes) == strconv.Itoa(common.Success) {
+		_ = t.uploadDB.Delete(uploadId)
+		t.syncUploadedFile(c, group, s, uploadId)
+	}
+}
+
+//putUploadRoute 记录或刷新上传会话
+func (t *Tracker) putUploadRoute(uploadId, group, addr string) error {
+	route := model.UploadRoute{
+		Group:      group,
+		Addr:       addr,
+		UpdateTime: time.Now().Unix(),
+	}
+	data, _ := json.Marshal(route)
+	return t.uploadDB.Put(uploadId, data)
+}
+
+//getUploadStorage 根据upload id获取上传会话所在的storage
+func (t *Tracker) getUploadStorage(uploadId string) (*Group, *StorageServer, error) {
+	data, err := t.uploadDB.Get(uploadId)
+	if err != nil {
+		return nil, nil, errors.New("no such upload")
+	}
+	var route model.UploadRoute
+	if err = json.Unmarshal(data, &route); err != nil {
+		return nil, nil, err
+	}
+	group := t.GetGroup(route.Group)
+	if group == nil {
+		return nil, nil, errors.New("no available group")
+	}
+	//排空中的storage继续处理已创建的上传会话
+	s := group.GetStorage(route.Addr)
+	if s == nil || !(s.Writable() || s.Status == common.StorageDraining) {
+		logger.Warn("upload storage unavailable", zap.String("upload_id", uploadId), zap.String("addr", route.Addr))
+		return nil, nil, errors.New("no available storage for upload")
+	}
+	return group, s, nil
+}
+
+//cleanExpiredUploadRoutes 清理过期的上传会话
+func (t *Tracker) cleanExpiredUploadRoutes() {
+	if !t.cluster.IsLeader() {
+		return
+	}
+	deadline := time.Now().Add(-uploadExpire()).Unix()
+	expired := make([]string, 0)
+	_ = t.uploadDB.Range("", func(key, value []byte) bool {
+		var route model.UploadRoute
+		if err := json.Unmarshal(value, &route); err != nil || route.UpdateTime < deadline {
+			expired = append(expired, string(key))
+		}
+		return true
+	})
+	_ = t.uploadDB.Delete(expired...)
+}
@@ -0,0 +1,113 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"eggdfs/logger"
+	"eggdfs/svc/conf"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//节点间请求
+//配置cluster_secret时为请求添加集群签名，https请求的tls设置见ClusterTLSConfig
+
+var (
+	nodeTransport     *http.Transport
+	nodeTransportOnce sync.Once
+
+	proxyTransport     *http.Transport
+	proxyTransportOnce sync.Once
+)
+
+//NodeClient 节点间请求使用的http客户端
+func NodeClient(timeout time.Duration) *http.Client {
+	nodeTransportOnce.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		cfg, err := ClusterTLSConfig()
+		if err != nil {
+			logger.Error("cluster tls config fail: " + err.Error())
+		} else {
+			t.TLSClientConfig = cfg
+		}
+		nodeTransport = t
+	})
+	return &http.Client{Timeout: timeout, Transport: nodeTransport}
+}
+
+//DoNodeRequest 发送节点间请求 body为请求体 用于计算签名
+func DoNodeRequest(req *http.Request, body []byte, timeout time.Duration) (*http.Response, error) {
+	if secret := conf.Config().ClusterSecret; secret != "" {
+		SignNodeRequest(req, secret, body)
+	}
+	return NodeClient(timeout).Do(req)
+}
+
+//ClusterTLSConfig 节点间请求的tls配置
+//配置cluster_cert与cluster_key时出示客户端证书，证书修改后自动重新加载
+func ClusterTLSConfig() (*tls.Config, error) {
+	cfg, err := clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	c := conf.Config()
+	if c.ClusterCert != "" && c.ClusterKey != "" {
+		cert, err := NewCertReloader(c.ClusterCert, c.ClusterKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetCertificate = cert.GetCertificate
+		cfg.GetClientCertificate = cert.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+//clientTLSConfig 发起https请求的tls配置 配置tls.ca_bundle或cluster_ca时只信任其中的ca，否则使用系统ca
+func clientTLSConfig() (*tls.Config, error) {
+	c := conf.Config()
+	version, err := TLSVersion(c.TLS.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{MinVersion: version}
+	if files := nonEmpty(c.TLS.CABundle, c.ClusterCA); len(files) > 0 {
+		if cfg.RootCAs, err = LoadCertPool(files...); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+//ProxyTransport tracker代理客户端请求使用的transport
+//信任的ca与节点间请求一致，但不出示集群证书，storage按客户端请求认证
+func ProxyTransport() http.RoundTripper {
+	proxyTransportOnce.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		cfg, err := clientTLSConfig()
+		if err != nil {
+			logger.Error("proxy tls config fail: " + err.Error())
+		} else {
+			t.TLSClientConfig = cfg
+		}
+		proxyTransport = t
+	})
+	return proxyTransport
+}
+
+//LoadCertPool 加载pem格式的ca证书
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate found in " + file)
+		}
+	}
+	return pool, nil
+}
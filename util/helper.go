@@ -91,9 +91,25 @@ func HttpPost(url string, data interface{}, header map[string]string, timeout ti
 		}
 	}
 	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
-	client := http.DefaultClient
-	client.Timeout = timeout
-	resp, err := client.Do(req.WithContext(context.TODO()))
+	resp, err := DoNodeRequest(req.WithContext(context.TODO()), b, timeout)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	res, err = io.ReadAll(resp.Body)
+	return res, err
+}
+
+//HttpGet 发送http get请求
+func HttpGet(url string, header map[string]string, timeout time.Duration) (res []byte, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := DoNodeRequest(req, nil, timeout)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//安全路径解析
+//storage所有文件操作的路径都是相对storage_dir的路径，来自请求参数、请求头或其他节点，
+//解析时拒绝绝对路径、..、NUL字节与反斜杠，并确认符号链接解析后仍在根目录内
+
+//ErrUnsafePath 路径可能逃逸根目录
+var ErrUnsafePath = errors.New("unsafe path")
+
+func unsafePath(p, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrUnsafePath, p, reason)
+}
+
+//CleanRelPath 校验并规范化相对路径 使用/分隔 空路径返回空
+func CleanRelPath(p string) (string, error) {
+	if strings.IndexByte(p, 0) >= 0 {
+		return "", unsafePath(p, "nul byte")
+	}
+	if strings.Contains(p, `\`) {
+		return "", unsafePath(p, "backslash")
+	}
+	if strings.HasPrefix(p, "/") || filepath.IsAbs(p) {
+		return "", unsafePath(p, "absolute path")
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return "", unsafePath(p, "parent reference")
+		}
+	}
+	if p = path.Clean(p); p == "." {
+		return "", nil
+	}
+	return p, nil
+}
+
+//CheckPathElem 校验文件名、上传id等单个路径元素
+func CheckPathElem(name string) error {
+	clean, err := CleanRelPath(name)
+	if err != nil {
+		return err
+	}
+	if clean == "" || clean != name || strings.Contains(name, "/") {
+		return unsafePath(name, "invalid path element")
+	}
+	return nil
+}
+
+//ResolvePath 解析root下的相对路径 返回完整路径
+//路径中已存在的部分解析符号链接后需仍在root内，指向不存在目标的符号链接同样拒绝
+func ResolvePath(root, rel string) (string, error) {
+	clean, err := CleanRelPath(rel)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(root, filepath.FromSlash(clean))
+	if err = checkSymlinks(root, full, clean); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
+//checkSymlinks 确认full已存在的最长前缀解析符号链接后仍在root内
+func checkSymlinks(root, full, rel string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	p := full
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			rel, err := filepath.Rel(realRoot, real)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return unsafePath(rel, "symlink escapes root")
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		//悬空的符号链接 创建文件时会写到链接目标
+		if fi, lerr := os.Lstat(p); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return unsafePath(rel, "dangling symlink")
+		}
+		//root已存在 最多向上解析到root
+		parent := filepath.Dir(p)
+		if parent == p {
+			return nil
+		}
+		p = parent
+	}
+}
@@ -0,0 +1,69 @@
+//go:build go1.18
+// +build go1.18
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzCleanRelPath(f *testing.F) {
+	for _, seed := range []string{"", "2021/1/1/a.txt", "../a", "/etc/passwd", "a/./b//c", "a\x00b", `..\a`, "a/..", "...", "a/.../b"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, p string) {
+		clean, err := CleanRelPath(p)
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(clean, "/") || strings.ContainsAny(clean, "\x00\\") {
+			t.Fatalf("CleanRelPath(%q) = %q", p, clean)
+		}
+		for _, elem := range strings.Split(clean, "/") {
+			if elem == ".." || elem == "." {
+				t.Fatalf("CleanRelPath(%q) = %q", p, clean)
+			}
+		}
+		//规范化后的路径再次解析结果不变
+		if again, err := CleanRelPath(clean); err != nil || again != clean {
+			t.Fatalf("CleanRelPath(%q) not idempotent: %q, %v", clean, again, err)
+		}
+	})
+}
+
+func FuzzResolvePath(f *testing.F) {
+	root := f.TempDir()
+	outside := f.TempDir()
+	_ = os.MkdirAll(filepath.Join(root, "2021", "1", "1"), os.ModePerm)
+	_ = os.Symlink(outside, filepath.Join(root, "2021", "out"))
+	for _, seed := range []string{"2021/1/1/a.txt", "2021/out/a.txt", "../" + filepath.Base(outside), "2021/1/../../..", "/tmp"} {
+		f.Add(seed)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, rel string) {
+		full, err := ResolvePath(root, rel)
+		if err != nil {
+			return
+		}
+		//解析结果在root内 已存在的部分解析符号链接后同样在root内
+		if full != root && !strings.HasPrefix(full, root+string(filepath.Separator)) {
+			t.Fatalf("ResolvePath(%q) = %q escapes %q", rel, full, root)
+		}
+		p := full
+		for {
+			if real, err := filepath.EvalSymlinks(p); err == nil {
+				if real != realRoot && !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+					t.Fatalf("ResolvePath(%q) = %q resolves to %q", rel, full, real)
+				}
+				break
+			}
+			p = filepath.Dir(p)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanRelPath(t *testing.T) {
+	ok := map[string]string{
+		"":                 "",
+		".":                "",
+		"2021/1/1/a.txt":   "2021/1/1/a.txt",
+		"2021//1/./a.txt":  "2021/1/a.txt",
+		"2021/1/1/dir/":    "2021/1/1/dir",
+		"a..b/c..":         "a..b/c..",
+		"2021/1/1/.hidden": "2021/1/1/.hidden",
+	}
+	for p, want := range ok {
+		got, err := CleanRelPath(p)
+		if err != nil || got != want {
+			t.Fatalf("CleanRelPath(%q) = %q, %v", p, got, err)
+		}
+	}
+	for _, p := range []string{"/etc/passwd", "../a", "a/../../b", "a/..", "a\x00b", `a\..\b`, "2021/../../x"} {
+		if _, err := CleanRelPath(p); !errors.Is(err, ErrUnsafePath) {
+			t.Fatalf("CleanRelPath(%q) accepted", p)
+		}
+	}
+}
+
+func TestResolvePathSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "in"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Skip("symlink not supported: ", err)
+	}
+	_ = os.Symlink(filepath.Join(root, "in"), filepath.Join(root, "alias"))
+	_ = os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+
+	if p, err := ResolvePath(root, "in/new/a.txt"); err != nil || p != filepath.Join(root, "in", "new", "a.txt") {
+		t.Fatalf("ResolvePath = %q, %v", p, err)
+	}
+	if _, err := ResolvePath(root, "alias/a.txt"); err != nil {
+		t.Fatalf("symlink inside root rejected: %v", err)
+	}
+	for _, p := range []string{"out", "out/a.txt", "out/x/y.txt", "dangling"} {
+		if _, err := ResolvePath(root, p); !errors.Is(err, ErrUnsafePath) {
+			t.Fatalf("ResolvePath(%q) accepted: %v", p, err)
+		}
+	}
+}
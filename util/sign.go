@@ -0,0 +1,162 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"eggdfs/common"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//SignToken hmac-sha256签名 多个字段以\n连接
+func SignToken(secret string, fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//VerifyToken 校验签名 常量时间比较
+func VerifyToken(secret, token string, fields ...string) bool {
+	expect := SignToken(secret, fields...)
+	return hmac.Equal([]byte(expect), []byte(token))
+}
+
+//SignExpireToken 生成带过期时间的签名 返回签名与过期时间戳
+func SignExpireToken(secret string, ttl time.Duration, fields ...string) (token string, expire string) {
+	expire = strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return SignToken(secret, append(fields, expire)...), expire
+}
+
+//VerifyExpireToken 校验带过期时间的签名
+func VerifyExpireToken(secret, token, expire string, fields ...string) bool {
+	exp, err := strconv.ParseInt(expire, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return VerifyToken(secret, token, append(fields, expire)...)
+}
+
+//SignDownload 生成下载签名参数token、expire ip不为空时绑定客户端ip并添加ip参数
+func SignDownload(secret, file, ip string, ttl time.Duration) url.Values {
+	fields := []string{file}
+	if ip != "" {
+		fields = append(fields, ip)
+	}
+	token, expire := SignExpireToken(secret, ttl, fields...)
+	q := url.Values{"token": {token}, "expire": {expire}}
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	return q
+}
+
+//VerifyDownload 校验下载签名 签名绑定ip时客户端ip需一致
+func VerifyDownload(secret string, q url.Values, file, clientIP string) bool {
+	fields := []string{file}
+	if ip := q.Get("ip"); ip != "" {
+		if ip != clientIP {
+			return false
+		}
+		fields = append(fields, ip)
+	}
+	return VerifyExpireToken(secret, q.Get("token"), q.Get("expire"), fields...)
+}
+
+//RandomHex 随机字节的hex编码
+func RandomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//SignRequest api key请求签名 query为排序后的查询参数 bodyHash为请求体sha256的hex编码
+func SignRequest(secret, method, path, query, bodyHash, timestamp, nonce string) string {
+	return SignToken(secret, method, path, query, bodyHash, timestamp, nonce)
+}
+
+//VerifyRequest 校验api key请求签名
+func VerifyRequest(secret, token, method, path, query, bodyHash, timestamp, nonce string) bool {
+	return VerifyToken(secret, token, method, path, query, bodyHash, timestamp, nonce)
+}
+
+//SetRequestSign 为请求添加api key签名头 body为请求体
+func SetRequestSign(req *http.Request, keyId, secret string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := RandomHex(16)
+	bodyHash := BodyHash(body)
+	req.Header.Set(common.HeaderAuthKey, keyId)
+	req.Header.Set(common.HeaderAuthTimestamp, timestamp)
+	req.Header.Set(common.HeaderAuthNonce, nonce)
+	req.Header.Set(common.HeaderAuthContentHash, bodyHash)
+	req.Header.Set(common.HeaderAuthSignature, SignRequest(secret, req.Method, req.URL.Path, req.URL.Query().Encode(), bodyHash, timestamp, nonce))
+}
+
+//BodyHash 请求体sha256的hex编码
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+//ErrBodyHashMismatch 请求体与签名的sha256不一致
+var ErrBodyHashMismatch = errors.New("request body hash mismatch")
+
+//bodyHashReader 读取请求体时计算sha256 读取结束时与签名的值不一致则返回错误
+type bodyHashReader struct {
+	io.ReadCloser
+	h      hash.Hash
+	expect string
+}
+
+func (r *bodyHashReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.h.Sum(nil)) != r.expect {
+		return n, ErrBodyHashMismatch
+	}
+	return n, err
+}
+
+//VerifyBodyReader 包装请求体 流式读取完成时校验sha256 用于无法预先读取的大请求体
+func VerifyBodyReader(body io.ReadCloser, bodyHash string) io.ReadCloser {
+	return &bodyHashReader{ReadCloser: body, h: sha256.New(), expect: bodyHash}
+}
+
+//SignNodeRequest 为节点间请求添加集群签名头 请求体的sha256参与签名
+func SignNodeRequest(req *http.Request, secret string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := RandomHex(16)
+	sum := sha256.Sum256(body)
+	req.Header.Set(common.HeaderNodeTimestamp, timestamp)
+	req.Header.Set(common.HeaderNodeNonce, nonce)
+	req.Header.Set(common.HeaderNodeSignature, SignToken(secret, req.Method, req.URL.Path, req.URL.Query().Encode(), hex.EncodeToString(sum[:]), timestamp, nonce))
+}
+
+//VerifyNodeRequest 校验节点间请求的集群签名 时间戳误差不能超过skew秒 返回nonce以及过期时间用于防重放
+func VerifyNodeRequest(req *http.Request, secret string, body []byte, skew int64) (nonce string, expire int64, err error) {
+	timestamp := req.Header.Get(common.HeaderNodeTimestamp)
+	nonce = req.Header.Get(common.HeaderNodeNonce)
+	signature := req.Header.Get(common.HeaderNodeSignature)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return "", 0, errors.New("missing node signature")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", 0, errors.New("invalid timestamp")
+	}
+	if now := time.Now().Unix(); ts < now-skew || ts > now+skew {
+		return "", 0, errors.New("request expired")
+	}
+	sum := sha256.Sum256(body)
+	if !VerifyToken(secret, signature, req.Method, req.URL.Path, req.URL.Query().Encode(), hex.EncodeToString(sum[:]), timestamp, nonce) {
+		return "", 0, errors.New("invalid node signature")
+	}
+	return nonce, ts + skew, nil
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"eggdfs/common"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireToken(t *testing.T) {
+	token, expire := SignExpireToken("secret", time.Minute, "g1/2021/1/1/a.txt")
+	if !VerifyExpireToken("secret", token, expire, "g1/2021/1/1/a.txt") {
+		t.Fatal("valid token rejected")
+	}
+	if VerifyExpireToken("secret", token, expire, "g1/2021/1/1/b.txt") {
+		t.Fatal("token accepted for another path")
+	}
+	if VerifyExpireToken("other", token, expire, "g1/2021/1/1/a.txt") {
+		t.Fatal("token accepted with another secret")
+	}
+	token, expire = SignExpireToken("secret", -time.Minute, "g1/2021/1/1/a.txt")
+	if VerifyExpireToken("secret", token, expire, "g1/2021/1/1/a.txt") {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestSignDownload(t *testing.T) {
+	q := SignDownload("secret", "g1/a.txt", "", time.Minute)
+	if !VerifyDownload("secret", q, "g1/a.txt", "10.0.0.1") {
+		t.Fatal("valid token rejected")
+	}
+	q = SignDownload("secret", "g1/a.txt", "10.0.0.1", time.Minute)
+	if !VerifyDownload("secret", q, "g1/a.txt", "10.0.0.1") {
+		t.Fatal("ip bound token rejected")
+	}
+	if VerifyDownload("secret", q, "g1/a.txt", "10.0.0.2") {
+		t.Fatal("token accepted from another ip")
+	}
+	//去掉ip参数后签名不再匹配
+	q.Del("ip")
+	if VerifyDownload("secret", q, "g1/a.txt", "10.0.0.2") {
+		t.Fatal("token accepted without ip")
+	}
+}
+
+func TestSetRequestSign(t *testing.T) {
+	body := []byte("file_id=1")
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:8081/delete?group=g1&file=a.txt", nil)
+	SetRequestSign(req, "k1", "secret", body)
+	h := req.Header
+	if h.Get(common.HeaderAuthKey) != "k1" || h.Get(common.HeaderAuthNonce) == "" {
+		t.Fatal("auth headers missing")
+	}
+	ts, nonce, sig := h.Get(common.HeaderAuthTimestamp), h.Get(common.HeaderAuthNonce), h.Get(common.HeaderAuthSignature)
+	bodyHash := h.Get(common.HeaderAuthContentHash)
+	if bodyHash != BodyHash(body) {
+		t.Fatal("body hash header missing")
+	}
+	//query参数顺序不影响签名
+	if !VerifyRequest("secret", sig, http.MethodPost, "/delete", "file=a.txt&group=g1", bodyHash, ts, nonce) {
+		t.Fatal("valid signature rejected")
+	}
+	if VerifyRequest("secret", sig, http.MethodPost, "/delete", "file=b.txt&group=g1", bodyHash, ts, nonce) {
+		t.Fatal("signature accepted for another query")
+	}
+	if VerifyRequest("secret", sig, http.MethodGet, "/delete", "file=a.txt&group=g1", bodyHash, ts, nonce) {
+		t.Fatal("signature accepted for another method")
+	}
+	if VerifyRequest("secret", sig, http.MethodPost, "/delete", "file=a.txt&group=g1", BodyHash([]byte("file_id=2")), ts, nonce) {
+		t.Fatal("signature accepted for another body")
+	}
+}
+
+func TestVerifyBodyReader(t *testing.T) {
+	read := func(body, expect string) error {
+		_, err := ioutil.ReadAll(VerifyBodyReader(ioutil.NopCloser(strings.NewReader(body)), BodyHash([]byte(expect))))
+		return err
+	}
+	if err := read("chunk data", "chunk data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := read("chunk data", "other data"); err != ErrBodyHashMismatch {
+		t.Fatal("mismatched body accepted")
+	}
+}
+
+func TestNodeRequestSign(t *testing.T) {
+	body := []byte(`{"action":1}`)
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/sync", nil)
+	SignNodeRequest(req, "cluster", body)
+	if _, _, err := VerifyNodeRequest(req, "cluster", body, 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyNodeRequest(req, "cluster", []byte(`{"action":2}`), 60); err == nil {
+		t.Fatal("signature accepted for another body")
+	}
+	if _, _, err := VerifyNodeRequest(req, "other", body, 60); err == nil {
+		t.Fatal("signature accepted with another secret")
+	}
+	req.Header.Del(common.HeaderNodeSignature)
+	if _, _, err := VerifyNodeRequest(req, "cluster", body, 60); err == nil {
+		t.Fatal("unsigned request accepted")
+	}
+}
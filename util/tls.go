@@ -0,0 +1,217 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"eggdfs/logger"
+	"eggdfs/svc/conf"
+	"errors"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//tls证书加载
+//证书、私钥以及ca文件修改后自动重新加载，每秒最多检查一次文件的修改时间，加载失败时继续使用原来的证书
+
+//certCheckInterval 检查证书文件修改的间隔
+const certCheckInterval = time.Second
+
+//tlsVersions min_version可选的值
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//TLSVersion 解析tls最低版本 为空时使用1.2
+func TLSVersion(v string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(v), "tls")]
+	if !ok {
+		return 0, errors.New("unknown tls version: " + v)
+	}
+	return version, nil
+}
+
+//fileReloader 文件修改后重新加载
+type fileReloader struct {
+	files     []string
+	load      func() error
+	mu        sync.Mutex
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+func newFileReloader(load func() error, files ...string) (*fileReloader, error) {
+	r := &fileReloader{files: files, load: load, modTimes: make([]time.Time, len(files))}
+	r.modTimes = r.stat()
+	r.lastCheck = time.Now()
+	if err := load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *fileReloader) stat() []time.Time {
+	times := make([]time.Time, len(r.files))
+	for i, f := range r.files {
+		if fi, err := os.Stat(f); err == nil {
+			times[i] = fi.ModTime()
+		}
+	}
+	return times
+}
+
+//check 文件修改时重新加载
+func (r *fileReloader) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < certCheckInterval {
+		return
+	}
+	r.lastCheck = time.Now()
+	times := r.stat()
+	changed := false
+	for i := range times {
+		if !times[i].Equal(r.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		logger.Error("tls reload fail", zap.Strings("files", r.files), zap.Error(err))
+		return
+	}
+	r.modTimes = times
+	logger.Info("tls reloaded", zap.Strings("files", r.files))
+}
+
+//CertReloader 自动重新加载的证书
+type CertReloader struct {
+	reloader *fileReloader
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+//NewCertReloader 加载证书与私钥
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{}
+	var err error
+	c.reloader, err = newFileReloader(func() error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.cert = &cert
+		c.mu.Unlock()
+		return nil
+	}, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Certificate 当前的证书
+func (c *CertReloader) Certificate() *tls.Certificate {
+	c.reloader.check()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+//PoolReloader 自动重新加载的ca证书
+type PoolReloader struct {
+	reloader *fileReloader
+	mu       sync.RWMutex
+	pool     *x509.CertPool
+}
+
+//NewPoolReloader 加载ca证书
+func NewPoolReloader(files ...string) (*PoolReloader, error) {
+	p := &PoolReloader{}
+	var err error
+	p.reloader, err = newFileReloader(func() error {
+		pool, err := LoadCertPool(files...)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.pool = pool
+		p.mu.Unlock()
+		return nil
+	}, files...)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//Pool 当前的ca证书
+func (p *PoolReloader) Pool() *x509.CertPool {
+	p.reloader.check()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+//TLSServerConfig http_schema为https时的服务端tls配置
+//配置tls.client_ca或cluster_ca时校验客户端出示的证书，未出示证书的请求由接口自行认证
+func TLSServerConfig() (*tls.Config, error) {
+	c := conf.Config()
+	if c.TLS.Cert == "" || c.TLS.Key == "" {
+		return nil, errors.New("tls cert and key required for https")
+	}
+	version, err := TLSVersion(c.TLS.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := NewCertReloader(c.TLS.Cert, c.TLS.Key)
+	if err != nil {
+		return nil, err
+	}
+	var clientCA *PoolReloader
+	if files := nonEmpty(c.TLS.ClientCA, c.ClusterCA); len(files) > 0 {
+		if clientCA, err = NewPoolReloader(files...); err != nil {
+			return nil, err
+		}
+	}
+	base := &tls.Config{MinVersion: version, GetCertificate: cert.GetCertificate}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := &tls.Config{
+			MinVersion:   version,
+			Certificates: []tls.Certificate{*cert.Certificate()},
+		}
+		if clientCA != nil {
+			cfg.ClientCAs = clientCA.Pool()
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		return cfg, nil
+	}
+	return base, nil
+}
+
+func nonEmpty(values ...string) []string {
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
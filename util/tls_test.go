@@ -0,0 +1,24 @@
+package util
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSVersion(t *testing.T) {
+	cases := map[string]uint16{
+		"":       tls.VersionTLS12,
+		"1.2":    tls.VersionTLS12,
+		"1.3":    tls.VersionTLS13,
+		"TLS1.3": tls.VersionTLS13,
+	}
+	for v, want := range cases {
+		got, err := TLSVersion(v)
+		if err != nil || got != want {
+			t.Fatalf("TLSVersion(%q) = %x, %v", v, got, err)
+		}
+	}
+	if _, err := TLSVersion("1.4"); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+}